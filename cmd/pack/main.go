@@ -19,22 +19,35 @@ Repository:
 
 Commands:
   new              Create a new project
+  generate         Create files from a generator, e.g. a component or a page
   start            Start the development server
   build            Build the application to disk
+  test             Run the tests
+  check            Type-check the project with tsc
   serve            Serve the built application
 
 Options:
   --port           Set the server port (default: 3000)
   --host           Set the server host (default: localhost)
+  --https          Serve over HTTPS with a locally trusted certificate
   --version        Print the current version and exit
 
 Examples:
   # Initialize a new project
   pack new <my-project>
 
+  # Add a page to the project
+  pack generate page <name>
+
   # Start the development server
   pack start
 
+  # Run the tests
+  pack test
+
+  # Type-check the project
+  pack check
+
   # Build your application to disk
   pack build
 
@@ -1,10 +1,12 @@
 module github.com/davezuko/pack
 
-go 1.15
+go 1.16
 
 require (
 	github.com/PuerkitoBio/goquery v1.6.1
+	github.com/andybalholm/brotli v1.0.4
 	github.com/evanw/esbuild v0.8.33
 	github.com/manifoldco/promptui v0.8.0
 	github.com/tdewolff/minify/v2 v2.9.10
+	golang.org/x/net v0.0.0-20200202094626-16171245cfb2
 )
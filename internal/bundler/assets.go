@@ -0,0 +1,181 @@
+package bundler
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+
+	"github.com/davezuko/pack/internal/fs"
+)
+
+// assetAttrs lists the html attributes that reference plain assets.
+var assetAttrs = []struct {
+	Selector string
+	Attr     string
+	Srcset   bool
+}{
+	{"img[src]", "src", false},
+	{"img[srcset]", "srcset", true},
+	{"source[src]", "src", false},
+	{"source[srcset]", "srcset", true},
+	{"video[src]", "src", false},
+	{"video[poster]", "poster", false},
+	{"audio[src]", "src", false},
+	{"track[src]", "src", false},
+	{"embed[src]", "src", false},
+	{"object[data]", "data", false},
+	{"input[type=image][src]", "src", false},
+	{"link[href]", "href", false},
+	{"meta[content]", "content", false},
+}
+
+// assetLinkRels are the <link> relations that point at files. Others, such
+// as "canonical" or "alternate", point at pages.
+var assetLinkRels = []string{
+	"icon",
+	"apple-touch-icon",
+	"apple-touch-icon-precomposed",
+	"mask-icon",
+	"manifest",
+	"preload",
+	"prefetch",
+}
+
+// assetMetaNames are the <meta> properties whose content is an asset url.
+var assetMetaNames = map[string]bool{
+	"og:image":                true,
+	"og:image:url":            true,
+	"og:image:secure_url":     true,
+	"og:video":                true,
+	"og:video:url":            true,
+	"og:video:secure_url":     true,
+	"og:audio":                true,
+	"og:audio:url":            true,
+	"og:audio:secure_url":     true,
+	"twitter:image":           true,
+	"twitter:player:stream":   true,
+	"msapplication-tileimage": true,
+}
+
+// rewriteAssets resolves every asset url in the page, reports the ones that
+// don't exist, and rewrites the rest to public urls. With opts.Hash,
+// assets from opts.Root are also copied to fingerprinted names, which are
+// returned for the caller to emit. Assets from opts.StaticDir keep their
+// names.
+func rewriteAssets(page *htmlPage) ([]OutputFile, []string) {
+	opts := page.BundleHTMLOptions
+	outputFiles := []OutputFile{}
+	errors := []string{}
+	rewritten := map[string]string{}
+
+	rewrite := func(attr string, uri string) string {
+		p, suffix, ok := resolveLocalURL(page, uri)
+		if !ok {
+			return uri
+		}
+		if out, ok := rewritten[p]; ok {
+			return publicURL(page, out) + suffix
+		}
+		out := p
+		contents, err := ioutil.ReadFile(path.Join(opts.Root, p))
+		if err == nil {
+			if opts.Hash {
+				out = fingerprint(opts, p, contents)
+				outputFiles = append(outputFiles, OutputFile{Path: out, Contents: contents})
+			}
+		} else if opts.StaticDir == "" || !fs.Exists(path.Join(opts.StaticDir, p)) {
+			errors = append(errors, fmt.Sprintf("%s: %s=%q references a missing file", opts.Path, attr, uri))
+			return uri
+		}
+		rewritten[p] = out
+		return publicURL(page, out) + suffix
+	}
+
+	for _, a := range assetAttrs {
+		page.Doc.Find(a.Selector).Each(func(i int, s *goquery.Selection) {
+			switch goquery.NodeName(s) {
+			case "link":
+				if !hasAnyRel(s, assetLinkRels) {
+					return
+				}
+			case "meta":
+				name := s.AttrOr("property", s.AttrOr("name", ""))
+				if !assetMetaNames[strings.ToLower(name)] {
+					return
+				}
+			}
+			value := s.AttrOr(a.Attr, "")
+			if value == "" {
+				return
+			}
+			if a.Srcset {
+				s.SetAttr(a.Attr, rewriteSrcset(value, func(uri string) string {
+					return rewrite(a.Attr, uri)
+				}))
+			} else {
+				s.SetAttr(a.Attr, rewrite(a.Attr, value))
+			}
+		})
+	}
+	return outputFiles, errors
+}
+
+// rewriteSrcset applies fn to each url in a srcset attribute, preserving the
+// width and density descriptors. Candidates are split the way browsers do:
+// a url runs up to the next whitespace, so the commas of data urls are part
+// of it, and its descriptors run up to the next comma.
+func rewriteSrcset(srcset string, fn func(string) string) string {
+	candidates := []string{}
+	rest := srcset
+	for {
+		rest = strings.TrimLeft(rest, " \t\n\r\f,")
+		if rest == "" {
+			break
+		}
+		end := strings.IndexAny(rest, " \t\n\r\f")
+		if end < 0 {
+			end = len(rest)
+		}
+		uri, descriptors := rest[:end], ""
+		rest = rest[end:]
+		if strings.HasSuffix(uri, ",") {
+			// A candidate without descriptors, e.g. "a.png, b.png 2x".
+			uri = strings.TrimRight(uri, ",")
+		} else if comma := strings.IndexByte(rest, ','); comma >= 0 {
+			descriptors, rest = rest[:comma], rest[comma+1:]
+		} else {
+			descriptors, rest = rest, ""
+		}
+		candidate := fn(uri)
+		if fields := strings.Fields(descriptors); len(fields) > 0 {
+			candidate += " " + strings.Join(fields, " ")
+		}
+		candidates = append(candidates, candidate)
+	}
+	return strings.Join(candidates, ", ")
+}
+
+// fingerprint inserts a hash of contents into the file name of p when
+// opts.Hash is set, e.g. "img/logo.png" -> "img/logo.1a2b3c4d.png".
+func fingerprint(opts BundleHTMLOptions, p string, contents []byte) string {
+	if !opts.Hash {
+		return p
+	}
+	sum := sha1.Sum(contents)
+	ext := path.Ext(p)
+	return strings.TrimSuffix(p, ext) + "." + hex.EncodeToString(sum[:])[:8] + ext
+}
+
+func hasAnyRel(s *goquery.Selection, rels []string) bool {
+	for _, rel := range rels {
+		if hasRel(s, rel) {
+			return true
+		}
+	}
+	return false
+}
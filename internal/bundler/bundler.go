@@ -1,14 +1,19 @@
 package bundler
 
 import (
+	"encoding/json"
 	"fmt"
+	"html"
+	"net/url"
 	"os"
 	"path"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/PuerkitoBio/goquery"
 	esbuild "github.com/evanw/esbuild/pkg/api"
+	nethtml "golang.org/x/net/html"
 )
 
 var rewritePackageImports = esbuild.Plugin{
@@ -47,15 +52,48 @@ var markAllImportsAsExternal = esbuild.Plugin{
 }
 
 type Bundler struct {
-	Bundle    func(files []string) esbuild.BuildResult
-	Transform func(file string) esbuild.BuildResult
+	Bundle      func(files []string) esbuild.BuildResult
+	BundleStdin func(stdin esbuild.StdinOptions) esbuild.BuildResult
+	Transform   func(file string) esbuild.BuildResult
 }
 
 type NewOptions struct {
+	// Mode is "development", "production" or "test". Test bundles target
+	// node.
 	Mode   string
 	Minify bool
+
+	// Root is the project's source directory. CSS module class names are
+	// derived from file paths relative to it.
+	Root string
+
+	// OnBuild is called after every build with a summary of it. Setting it
+	// has esbuild emit metadata about the build, from which the module graph
+	// is read.
+	OnBuild func(BuildInfo)
+
+	// Plugins run after the built-in ones.
+	Plugins []esbuild.Plugin
 }
 
+// BuildInfo summarizes a build for diagnostics.
+type BuildInfo struct {
+	Entries  []string
+	Start    time.Time
+	Duration time.Duration
+	Errors   []string
+	Warnings []string
+
+	// Imports maps every input of the build to the inputs it imports.
+	Imports map[string][]string
+	// Outputs maps output files to their size in bytes.
+	Outputs map[string]int
+}
+
+// metafile is the path esbuild writes build metadata to. It is removed from
+// the output files.
+const metafile = "/dist/__metafile.json"
+
 func New(opts NewOptions) Bundler {
 	defines := map[string]string{
 		"process.env.NODE_ENV": "\"" + opts.Mode + "\"",
@@ -70,22 +108,59 @@ func New(opts NewOptions) Bundler {
 		// 1. esbuild can emit > 1 file
 		// 2. we can strip the output directory from all OutputFiles
 		// before returning to the caller. They never see "dist".
-		Outdir: "/dist",
+		Outdir:  "/dist",
+		Outbase: opts.Root,
+		Plugins: append([]esbuild.Plugin{cssModules(opts)}, opts.Plugins...),
+	}
+	// Tests run in node, and their stack traces should point at the sources.
+	if opts.Mode == "test" {
+		buildOptions.Platform = esbuild.PlatformNode
+		buildOptions.Format = esbuild.FormatCommonJS
+		buildOptions.Sourcemap = esbuild.SourceMapLinked
 	}
 	if opts.Minify {
 		buildOptions.MinifySyntax = true
 		buildOptions.MinifyWhitespace = true
 		buildOptions.MinifyIdentifiers = true
 	}
+	build := func(buildOptions esbuild.BuildOptions, entries []string) esbuild.BuildResult {
+		if opts.OnBuild != nil {
+			buildOptions.Metafile = metafile
+		}
+		start := time.Now()
+		result := esbuild.Build(buildOptions)
+		info := BuildInfo{Entries: entries, Start: start, Duration: time.Since(start)}
+		outputFiles := result.OutputFiles[:0]
+		for _, f := range result.OutputFiles {
+			if f.Path == metafile {
+				info.Imports, info.Outputs = readMetafile(f.Contents)
+				continue
+			}
+			f.Path = strings.TrimPrefix(f.Path, "/dist/")
+			outputFiles = append(outputFiles, f)
+		}
+		result.OutputFiles = outputFiles
+		if opts.OnBuild != nil {
+			for _, msg := range result.Errors {
+				info.Errors = append(info.Errors, formatMessage(msg))
+			}
+			for _, msg := range result.Warnings {
+				info.Warnings = append(info.Warnings, formatMessage(msg))
+			}
+			opts.OnBuild(info)
+		}
+		return result
+	}
 	return Bundler{
 		Bundle: func(files []string) esbuild.BuildResult {
 			opts := buildOptions
 			opts.EntryPoints = files
-			result := esbuild.Build(opts)
-			for i := range result.OutputFiles {
-				result.OutputFiles[i].Path = strings.TrimPrefix(result.OutputFiles[i].Path, "/dist/")
-			}
-			return result
+			return build(opts, files)
+		},
+		BundleStdin: func(stdin esbuild.StdinOptions) esbuild.BuildResult {
+			opts := buildOptions
+			opts.Stdin = &stdin
+			return build(opts, []string{stdin.Sourcefile})
 		},
 		Transform: func(file string) esbuild.BuildResult {
 			opts := buildOptions
@@ -96,6 +171,49 @@ func New(opts NewOptions) Bundler {
 	}
 }
 
+// readMetafile reads the module graph and output sizes from esbuild's build
+// metadata.
+func readMetafile(data []byte) (map[string][]string, map[string]int) {
+	var meta struct {
+		Inputs map[string]struct {
+			Imports []struct {
+				Path string `json:"path"`
+			} `json:"imports"`
+		} `json:"inputs"`
+		Outputs map[string]struct {
+			Bytes int `json:"bytes"`
+		} `json:"outputs"`
+	}
+	imports := map[string][]string{}
+	outputs := map[string]int{}
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return imports, outputs
+	}
+	for input, m := range meta.Inputs {
+		imports[input] = []string{}
+		for _, imp := range m.Imports {
+			imports[input] = append(imports[input], imp.Path)
+		}
+	}
+	// Outputs are relative to the working directory.
+	outdir, _ := filepath.Abs("/dist")
+	for output, m := range meta.Outputs {
+		abs, _ := filepath.Abs(output)
+		if rel, err := filepath.Rel(outdir, abs); err == nil {
+			output = filepath.ToSlash(rel)
+		}
+		outputs[output] = m.Bytes
+	}
+	return imports, outputs
+}
+
+func formatMessage(msg esbuild.Message) string {
+	if msg.Location == nil {
+		return msg.Text
+	}
+	return fmt.Sprintf("%s:%d:%d: %s", msg.Location.File, msg.Location.Line, msg.Location.Column, msg.Text)
+}
+
 type OutputFile struct {
 	Path     string
 	Contents []byte
@@ -105,6 +223,32 @@ type BundleHTMLOptions struct {
 	Bundler Bundler
 	Path    string
 	Root    string
+
+	// StaticDir holds assets that are served as-is. Urls that don't resolve
+	// to a file in Root are looked up here.
+	StaticDir string
+
+	// PublicPath is the url the site is deployed under, such as "/app/" or
+	// "https://cdn.example.com/app/". It prefixes every url that is emitted
+	// into the page. Defaults to "/".
+	PublicPath string
+
+	// Hash adds a content hash to the names of bundles and assets from Root.
+	Hash bool
+
+	// InlineLimit is the size in bytes up to which bundled inline scripts and
+	// styles are kept inline. Larger outputs are emitted as separate files.
+	InlineLimit int
+
+	// Development leaves referenced scripts and stylesheets unbundled, since
+	// the development server bundles those on request. Inline scripts and
+	// styles are still bundled, and always kept inline.
+	Development bool
+
+	// OnDocument is called with the parsed page before anything in it is
+	// bundled, so changes to the document are bundled like the rest of it.
+	// Returning an error fails the page.
+	OnDocument func(doc *goquery.Document) error
 }
 
 type BundleHTMLResult struct {
@@ -112,6 +256,20 @@ type BundleHTMLResult struct {
 	Errors      []string
 }
 
+// htmlPage is an html document that is being bundled.
+type htmlPage struct {
+	BundleHTMLOptions
+	Doc *goquery.Document
+
+	// Base is the url that relative urls in the page resolve against. It is
+	// the page's own url unless the page has a <base href>.
+	Base *url.URL
+}
+
+// BundleHTML bundles the scripts and stylesheets referenced by an html page
+// and rewrites their tags in place to point at the bundled output. All other
+// attributes (type, async, defer, media, ...) and the original ordering of
+// the tags are preserved.
 func BundleHTML(opts BundleHTMLOptions) (result BundleHTMLResult) {
 	result.Errors = []string{}
 
@@ -128,73 +286,311 @@ func BundleHTML(opts BundleHTMLOptions) (result BundleHTMLResult) {
 		return
 	}
 
+	if opts.OnDocument != nil {
+		if err := opts.OnDocument(doc); err != nil {
+			result.Errors = append(result.Errors, err.Error())
+			return
+		}
+	}
+
 	// <root>/path/to/index.html -> path/to/index.html
 	outfile, _ := filepath.Rel(opts.Root, opts.Path)
 
-	// Consume all local scripts and stylesheets from the html document
-	entries := []string{}
-	doc.Find("script").Each(func(i int, s *goquery.Selection) {
-		if uri, ok := s.Attr("src"); ok {
-			if uri == "" {
-				return // warn?
-			}
-			switch {
-			case strings.HasPrefix(uri, "./"):
-				entries = append(entries, path.Join(path.Dir(opts.Path), uri))
-				s.Remove()
-			case strings.HasPrefix(uri, "/") && !strings.HasPrefix(uri, "//"):
-				entries = append(entries, path.Join(opts.Root, uri))
-				s.Remove()
+	page := &htmlPage{BundleHTMLOptions: opts, Doc: doc}
+	page.Base = &url.URL{Path: "/" + filepath.ToSlash(outfile)}
+	if s := doc.Find("base[href]").First(); s.Length() > 0 {
+		if u, err := url.Parse(s.AttrOr("href", "")); err == nil {
+			page.Base = page.Base.ResolveReference(u)
+			if p, suffix, ok := resolveLocalURL(page, "./"); ok {
+				s.SetAttr("href", publicURL(page, p)+suffix)
 			}
 		}
+	}
 
-	})
-	doc.Find("link").Each(func(i int, s *goquery.Selection) {
-		if uri, ok := s.Attr("href"); ok {
-			if uri == "" {
-				return // warn?
-			}
-			switch {
-			case strings.HasPrefix(uri, "./"):
-				entries = append(entries, path.Join(path.Dir(opts.Path), uri))
-				s.Remove()
-			case strings.HasPrefix(uri, "/") && !strings.HasPrefix(uri, "//"):
-				entries = append(entries, path.Join(opts.Root, uri))
-				s.Remove()
+	// Only scripts and stylesheets are bundle entries. Other links (icons,
+	// manifests, preloads, ...) point at plain assets.
+	scripts := []string{}
+	styles := []string{}
+	refs := []entryRef{}
+	seen := map[string]bool{}
+	addEntry := func(s *goquery.Selection, attr string, ext string) {
+		uri := s.AttrOr(attr, "")
+		if uri == "" {
+			return // warn?
+		}
+		p, suffix, ok := resolveLocalURL(page, uri)
+		if !ok {
+			return
+		}
+		file := path.Join(opts.Root, p)
+		if !seen[file] {
+			seen[file] = true
+			if ext == ".js" {
+				scripts = append(scripts, file)
+			} else {
+				styles = append(styles, file)
 			}
 		}
+		refs = append(refs, entryRef{Selection: s, Attr: attr, Path: p, Suffix: suffix, Ext: ext})
+	}
+	doc.Find("script[src]").Each(func(i int, s *goquery.Selection) {
+		addEntry(s, "src", ".js")
+	})
+	doc.Find("link[href]").Each(func(i int, s *goquery.Selection) {
+		if hasRel(s, "stylesheet") {
+			addEntry(s, "href", ".css")
+		}
 	})
 
-	if len(entries) == 0 {
+	// Missing assets aren't fatal in development, where the page is rebuilt
+	// on every request.
+	assetFiles, assetErrors := rewriteAssets(page)
+	if !opts.Development {
+		result.OutputFiles = append(result.OutputFiles, assetFiles...)
+		result.Errors = append(result.Errors, assetErrors...)
+	}
+
+	// Inline blocks are bundled after collecting entries so that the files
+	// they may be moved to aren't mistaken for entries.
+	inlineFiles, inlineErrors := bundleInline(page)
+	result.OutputFiles = append(result.OutputFiles, inlineFiles...)
+	result.Errors = append(result.Errors, inlineErrors...)
+	if len(result.Errors) > 0 {
+		result.OutputFiles = nil
+		return
+	}
+	if opts.Development || len(refs) == 0 {
+		// The development server bundles entries when they're requested, so
+		// only their urls need to account for the public path.
+		for _, ref := range refs {
+			ref.Selection.SetAttr(ref.Attr, publicURL(page, ref.Path)+ref.Suffix)
+		}
 		html, _ := doc.Html()
-		result.OutputFiles = []OutputFile{{Path: outfile, Contents: []byte(html)}}
+		result.OutputFiles = append(result.OutputFiles, OutputFile{Path: outfile, Contents: []byte(html)})
 		return
 	}
 
-	bundleResult := opts.Bundler.Bundle(entries)
-	if len(bundleResult.Errors) > 0 {
+	// Stylesheets and scripts are bundled separately because a script that
+	// imports css emits a stylesheet named after itself, which may collide
+	// with a stylesheet entry of the same name (e.g. main.ts and main.css).
+	// In that case the script's stylesheet is renamed to <name>.js.css.
+	//
+	// Both maps go from the path esbuild emitted to the final output path.
+	styleOutputs := map[string]string{}
+	scriptOutputs := map[string]string{}
+	groups := []struct {
+		Entries []string
+		Outputs map[string]string
+	}{{styles, styleOutputs}, {scripts, scriptOutputs}}
+	for _, group := range groups {
+		if len(group.Entries) == 0 {
+			continue
+		}
+		bundleResult := opts.Bundler.Bundle(group.Entries)
 		for i := range bundleResult.Errors {
 			result.Errors = append(result.Errors, bundleResult.Errors[i].Text)
 		}
+		for _, f := range bundleResult.OutputFiles {
+			p := f.Path
+			if _, ok := styleOutputs[p]; ok && path.Ext(p) == ".css" {
+				p = strings.TrimSuffix(p, ".css") + ".js.css"
+			}
+			p = fingerprint(opts, p, f.Contents)
+			group.Outputs[f.Path] = p
+			result.OutputFiles = append(result.OutputFiles, OutputFile{Path: p, Contents: f.Contents})
+		}
+	}
+	if len(result.Errors) > 0 {
+		result.OutputFiles = nil
 		return
 	}
 
-	result.OutputFiles = make([]OutputFile, 0, len(bundleResult.OutputFiles)+1)
+	// Stylesheets imported by scripts need a <link> of their own.
+	linked := map[string]bool{}
 	head := doc.Find("head")
-	body := doc.Find("body")
-	for _, f := range bundleResult.OutputFiles {
-		switch path.Ext(f.Path) {
-		case ".css":
-			head.AppendHtml(fmt.Sprintf("<link rel=\"stylesheet\" href=\"%s\" />", f.Path))
-		case ".js":
-			// TODO: which scripts should be appended?
-			// TODO: consider script type?
-			body.AppendHtml(fmt.Sprintf("<script src=\"%s\"></script>", f.Path))
+	for _, ref := range refs {
+		stem := strings.TrimSuffix(ref.Path, path.Ext(ref.Path))
+		if ref.Ext == ".css" {
+			ref.Selection.SetAttr(ref.Attr, publicURL(page, styleOutputs[stem+".css"]))
+			continue
+		}
+		ref.Selection.SetAttr(ref.Attr, publicURL(page, scriptOutputs[stem+".js"]))
+		if css, ok := scriptOutputs[stem+".css"]; ok && !linked[css] {
+			linked[css] = true
+			head.AppendHtml(fmt.Sprintf("<link rel=\"stylesheet\" href=\"%s\" />", publicURL(page, css)))
 		}
-		result.OutputFiles = append(result.OutputFiles, OutputFile{Path: f.Path, Contents: f.Contents})
 	}
 
 	html, _ := doc.Html()
 	result.OutputFiles = append(result.OutputFiles, OutputFile{Path: outfile, Contents: []byte(html)})
 	return
 }
+
+// bundleInline bundles inline module scripts and styles in place. Outputs
+// larger than opts.InlineLimit are moved to separate files, which are
+// returned for the caller to emit.
+func bundleInline(page *htmlPage) ([]OutputFile, []string) {
+	opts := page.BundleHTMLOptions
+	outputFiles := []OutputFile{}
+	errors := []string{}
+	stem := outputStem(opts.Root, opts.Path)
+	resolveDir, _ := filepath.Abs(filepath.Dir(opts.Path))
+	head := page.Doc.Find("head")
+	n := 0
+
+	page.Doc.Find("script:not([src]), style").Each(func(i int, s *goquery.Selection) {
+		tag := goquery.NodeName(s)
+		loader := esbuild.LoaderCSS
+		if tag == "script" {
+			// Classic scripts may rely on sharing globals with one another, so
+			// only modules are safe to bundle.
+			if s.AttrOr("type", "") != "module" {
+				return
+			}
+			loader = esbuild.LoaderTS
+		}
+		n++
+		bundleResult := opts.Bundler.BundleStdin(esbuild.StdinOptions{
+			Contents:   s.Text(),
+			ResolveDir: resolveDir,
+			Sourcefile: fmt.Sprintf("%s (inline %s #%d)", filepath.Base(opts.Path), tag, n),
+			Loader:     loader,
+		})
+		for _, msg := range bundleResult.Errors {
+			errors = append(errors, msg.Text)
+		}
+		if len(bundleResult.Errors) > 0 {
+			return
+		}
+		for _, f := range bundleResult.OutputFiles {
+			ext := path.Ext(f.Path)
+			name := fingerprint(opts, fmt.Sprintf("%s.inline-%d%s", stem, n, ext), f.Contents)
+			inline := opts.Development || len(f.Contents) <= opts.InlineLimit
+			if !inline {
+				outputFiles = append(outputFiles, OutputFile{Path: name, Contents: f.Contents})
+			}
+			switch {
+			case ext == ".js" && inline:
+				setRawText(s, string(f.Contents))
+			case ext == ".js":
+				s.Empty()
+				s.SetAttr("src", publicURL(page, name))
+			case tag == "style" && inline:
+				setRawText(s, string(f.Contents))
+			case tag == "style":
+				link := fmt.Sprintf("<link rel=\"stylesheet\" href=\"%s\" />", publicURL(page, name))
+				if media, ok := s.Attr("media"); ok {
+					link = fmt.Sprintf("<link rel=\"stylesheet\" href=\"%s\" media=\"%s\" />", publicURL(page, name), html.EscapeString(media))
+				}
+				s.ReplaceWithHtml(link)
+			case inline:
+				// css imported by an inline script
+				head.AppendHtml("<style></style>")
+				setRawText(head.Children().Last(), string(f.Contents))
+			default:
+				head.AppendHtml(fmt.Sprintf("<link rel=\"stylesheet\" href=\"%s\" />", publicURL(page, name)))
+			}
+		}
+	})
+	return outputFiles, errors
+}
+
+// setRawText replaces the contents of a <script> or <style> element. Unlike
+// Selection.SetText the text is not escaped, since these elements hold raw
+// text.
+func setRawText(s *goquery.Selection, text string) {
+	s.Empty()
+	for _, n := range s.Nodes {
+		n.AppendChild(&nethtml.Node{Type: nethtml.TextNode, Data: text})
+	}
+}
+
+// entryRef is an html attribute that references a bundle entry.
+type entryRef struct {
+	Selection *goquery.Selection
+	Attr      string
+	Path      string // source path relative to the root
+	Suffix    string // query and fragment of the original url
+	Ext       string // extension of the bundled output
+}
+
+// resolveLocalURL maps a url found in an html page to a path relative to the
+// site root, and returns it along with the url's query and fragment. It
+// reports false for urls that point elsewhere (other hosts, data urls, ...).
+func resolveLocalURL(page *htmlPage, uri string) (string, string, bool) {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "" || u.Host != "" || u.Path == "" {
+		return "", "", false
+	}
+	u = page.Base.ResolveReference(u)
+	if u.Scheme != "" || u.Host != "" {
+		return "", "", false // <base href> points at another host
+	}
+	var suffix string
+	if u.RawQuery != "" {
+		suffix += "?" + u.RawQuery
+	}
+	if u.Fragment != "" {
+		suffix += "#" + u.Fragment
+	}
+
+	// Urls may already include the public path, typically because of a
+	// <base href> that matches it. They are still relative to the root.
+	p := u.Path
+	if prefix := PublicPathPrefix(page.PublicPath); prefix != "/" && strings.HasPrefix(p, prefix) {
+		p = "/" + strings.TrimPrefix(p, prefix)
+	}
+	p = strings.TrimPrefix(p, "/")
+	if p == "" {
+		p = "."
+	}
+	return p, suffix, true
+}
+
+// publicURL returns the url that the output file p is served from.
+func publicURL(page *htmlPage, p string) string {
+	base := page.PublicPath
+	if base == "" {
+		base = "/"
+	}
+	if !strings.HasSuffix(base, "/") {
+		base += "/"
+	}
+	if p == "." {
+		return base
+	}
+	return base + p
+}
+
+// PublicPathPrefix returns the path component of a public path, with leading
+// and trailing slashes. This is the path that servers mount the site under.
+func PublicPathPrefix(publicPath string) string {
+	if u, err := url.Parse(publicPath); err == nil {
+		publicPath = u.Path
+	}
+	publicPath = strings.Trim(publicPath, "/")
+	if publicPath == "" {
+		return "/"
+	}
+	return "/" + publicPath + "/"
+}
+
+// outputStem returns the path that esbuild will emit file to, relative to the
+// root and without an extension.
+func outputStem(root string, file string) string {
+	rel, err := filepath.Rel(root, file)
+	if err != nil {
+		rel = filepath.Base(file)
+	}
+	rel = filepath.ToSlash(rel)
+	return strings.TrimSuffix(rel, path.Ext(rel))
+}
+
+func hasRel(s *goquery.Selection, rel string) bool {
+	for _, r := range strings.Fields(s.AttrOr("rel", "")) {
+		if strings.EqualFold(r, rel) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,376 @@
+package bundler
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	esbuild "github.com/evanw/esbuild/pkg/api"
+)
+
+// CSS modules are implemented with two virtual namespaces. Importing
+// "foo.module.css" from a script resolves to a JavaScript module in the
+// "css-module" namespace that exports the generated class name map. In
+// production that module imports the scoped stylesheet from the
+// "css-module-style" namespace so that esbuild emits it next to the bundle.
+// In development the stylesheet is injected at runtime instead, since the
+// dev server only serves the JavaScript output.
+const (
+	cssModuleNamespace      = "css-module"
+	cssModuleStyleNamespace = "css-module-style"
+)
+
+func cssModules(opts NewOptions) esbuild.Plugin {
+	return esbuild.Plugin{
+		Name: "css-modules",
+		Setup: func(build esbuild.PluginBuild) {
+			build.OnResolve(esbuild.OnResolveOptions{
+				Filter:    `\.module\.css$`,
+				Namespace: "file",
+			}, func(args esbuild.OnResolveArgs) (esbuild.OnResolveResult, error) {
+				// Stylesheets used directly as entry points (e.g. from a <link>)
+				// are left to esbuild's regular css loader.
+				if args.Importer == "" {
+					return esbuild.OnResolveResult{}, nil
+				}
+				p := args.Path
+				if !filepath.IsAbs(p) {
+					if !strings.HasPrefix(p, "./") && !strings.HasPrefix(p, "../") {
+						return esbuild.OnResolveResult{}, nil
+					}
+					p = filepath.Join(args.ResolveDir, p)
+				}
+				// Paths in virtual namespaces show up verbatim in output comments,
+				// so keep them relative to the working directory like esbuild does
+				// for regular files.
+				if cwd, err := os.Getwd(); err == nil {
+					if rel, err := filepath.Rel(cwd, p); err == nil {
+						p = filepath.ToSlash(rel)
+					}
+				}
+				return esbuild.OnResolveResult{Path: p, Namespace: cssModuleNamespace}, nil
+			})
+			build.OnResolve(esbuild.OnResolveOptions{
+				Filter:    "^" + cssModuleStyleNamespace + ":",
+				Namespace: cssModuleNamespace,
+			}, func(args esbuild.OnResolveArgs) (esbuild.OnResolveResult, error) {
+				return esbuild.OnResolveResult{
+					Path:      strings.TrimPrefix(args.Path, cssModuleStyleNamespace+":"),
+					Namespace: cssModuleStyleNamespace,
+				}, nil
+			})
+			build.OnLoad(esbuild.OnLoadOptions{
+				Filter:    ".*",
+				Namespace: cssModuleNamespace,
+			}, func(args esbuild.OnLoadArgs) (esbuild.OnLoadResult, error) {
+				mod, err := loadCSSModule(args.Path, opts.Root)
+				if err != nil {
+					return esbuild.OnLoadResult{}, err
+				}
+				if err := writeCSSModuleTypes(args.Path, mod.Classes); err != nil {
+					return esbuild.OnLoadResult{}, err
+				}
+				classes, _ := json.Marshal(mod.Classes)
+				var js string
+				if opts.Mode == "production" {
+					js = fmt.Sprintf("import %q;\nexport default %s;\n", cssModuleStyleNamespace+":"+args.Path, classes)
+				} else {
+					css, _ := json.Marshal(mod.CSS)
+					id, _ := json.Marshal(mod.ID)
+					js = fmt.Sprintf(`if (typeof document !== "undefined") {
+  const style = document.createElement("style");
+  style.setAttribute("data-css-module", %s);
+  style.textContent = %s;
+  document.head.appendChild(style);
+}
+export default %s;
+`, id, css, classes)
+				}
+				return esbuild.OnLoadResult{
+					Contents:   &js,
+					ResolveDir: resolveDir(args.Path),
+					Loader:     esbuild.LoaderJS,
+				}, nil
+			})
+			build.OnLoad(esbuild.OnLoadOptions{
+				Filter:    ".*",
+				Namespace: cssModuleStyleNamespace,
+			}, func(args esbuild.OnLoadArgs) (esbuild.OnLoadResult, error) {
+				mod, err := loadCSSModule(args.Path, opts.Root)
+				if err != nil {
+					return esbuild.OnLoadResult{}, err
+				}
+				return esbuild.OnLoadResult{
+					Contents:   &mod.CSS,
+					ResolveDir: resolveDir(args.Path),
+					Loader:     esbuild.LoaderCSS,
+				}, nil
+			})
+		},
+	}
+}
+
+func resolveDir(file string) string {
+	dir, err := filepath.Abs(filepath.Dir(file))
+	if err != nil {
+		return filepath.Dir(file)
+	}
+	return dir
+}
+
+type cssModule struct {
+	ID      string
+	CSS     string
+	Classes map[string]string
+}
+
+func loadCSSModule(file string, root string) (cssModule, error) {
+	src, err := ioutil.ReadFile(file)
+	if err != nil {
+		return cssModule{}, err
+	}
+	id := file
+	if root != "" {
+		absRoot, err1 := filepath.Abs(root)
+		absFile, err2 := filepath.Abs(file)
+		if err1 == nil && err2 == nil {
+			if rel, err := filepath.Rel(absRoot, absFile); err == nil {
+				id = rel
+			}
+		}
+	}
+	id = filepath.ToSlash(id)
+	css, classes := scopeCSS(string(src), cssModuleSuffix(id))
+	return cssModule{ID: id, CSS: css, Classes: classes}, nil
+}
+
+// cssModuleSuffix derives the suffix appended to every class name in a CSS
+// module. It depends only on the file's path relative to the source root so
+// that the development server and production builds agree on class names.
+func cssModuleSuffix(id string) string {
+	sum := sha1.Sum([]byte(id))
+	return hex.EncodeToString(sum[:])[:6]
+}
+
+// cssModuleTypesLocks holds a *sync.Mutex for every declaration file, since
+// concurrent builds can load the same CSS module.
+var cssModuleTypesLocks sync.Map
+
+// writeCSSModuleTypes writes a TypeScript declaration file next to the CSS
+// module so that `tsc` can type-check its class names. The file is only
+// rewritten when its contents change to avoid triggering file watchers, and
+// is replaced atomically so that they never see it half-written.
+func writeCSSModuleTypes(file string, classes map[string]string) error {
+	names := make([]string, 0, len(classes))
+	for name := range classes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	buf.WriteString("// This file is generated by pack. Do not edit.\n")
+	buf.WriteString("declare const styles: {\n")
+	for _, name := range names {
+		fmt.Fprintf(&buf, "  readonly %q: string;\n", name)
+	}
+	buf.WriteString("};\nexport default styles;\n")
+
+	out := file + ".d.ts"
+	lock, _ := cssModuleTypesLocks.LoadOrStore(out, &sync.Mutex{})
+	lock.(*sync.Mutex).Lock()
+	defer lock.(*sync.Mutex).Unlock()
+	if existing, err := ioutil.ReadFile(out); err == nil && bytes.Equal(existing, buf.Bytes()) {
+		return nil
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(out), filepath.Base(out)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), out)
+}
+
+// scopeCSS rewrites every class selector in src by appending suffix to it, and
+// returns the rewritten stylesheet along with a map of original to scoped
+// class names. Selectors wrapped in :global(...) are left untouched, as is the
+// rest of a selector after a bare :global, e.g. ".a :global .b".
+func scopeCSS(src string, suffix string) (string, map[string]string) {
+	var out strings.Builder
+	classes := map[string]string{}
+
+	// Each open block records whether its contents are rules (and therefore
+	// begin with selectors) or declarations.
+	stack := []bool{true}
+	inSelector := func() bool { return stack[len(stack)-1] }
+	atRule := false // the current prelude belongs to an at-rule
+	preludeStart := true
+	globalDepth := 0 // paren depth inside :global(...)
+	parenDepth := 0
+	global := false // after a bare :global, until the end of the selector
+
+	for i := 0; i < len(src); {
+		c := src[i]
+
+		// Comments and strings are copied verbatim.
+		if c == '/' && i+1 < len(src) && src[i+1] == '*' {
+			end := strings.Index(src[i+2:], "*/")
+			if end < 0 {
+				out.WriteString(src[i:])
+				break
+			}
+			out.WriteString(src[i : i+2+end+2])
+			i += 2 + end + 2
+			continue
+		}
+		if c == '"' || c == '\'' {
+			j := i + 1
+			for j < len(src) && src[j] != c {
+				if src[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j < len(src) {
+				j++
+			}
+			out.WriteString(src[i:j])
+			i = j
+			continue
+		}
+
+		if preludeStart && !isCSSSpace(c) {
+			preludeStart = false
+			atRule = c == '@'
+		}
+
+		switch {
+		case c == '{':
+			if !inSelector() {
+				stack = append(stack, false)
+			} else if atRule {
+				// Conditional group rules contain more rules; everything else
+				// (@font-face, @keyframes, @page, ...) is left alone.
+				name := atRuleName(src, i)
+				stack = append(stack, name == "media" || name == "supports" || name == "document")
+			} else {
+				stack = append(stack, false)
+			}
+			preludeStart = true
+			globalDepth, parenDepth = 0, 0
+			global = false
+		case c == '}':
+			if len(stack) > 1 {
+				stack = stack[:len(stack)-1]
+			}
+			preludeStart = true
+		case c == ';':
+			preludeStart = true
+		case inSelector() && !atRule && c == '(':
+			parenDepth++
+		case inSelector() && !atRule && c == ')':
+			if globalDepth > 0 && parenDepth == globalDepth {
+				globalDepth = 0
+				parenDepth--
+				i++
+				continue
+			}
+			parenDepth--
+		case inSelector() && !atRule && strings.HasPrefix(src[i:], ":global("):
+			parenDepth++
+			globalDepth = parenDepth
+			i += len(":global(")
+			continue
+		case inSelector() && !atRule && isBareGlobal(src[i:]):
+			// The pseudo-class is dropped along with the whitespace after it,
+			// unless it's the only combinator: ".a:global .b" is ".a .b".
+			global = true
+			start := i
+			i += len(":global")
+			if start == 0 || isCSSSpace(src[start-1]) || strings.IndexByte("{},;/", src[start-1]) >= 0 {
+				for i < len(src) && isCSSSpace(src[i]) {
+					i++
+				}
+			}
+			continue
+		case inSelector() && !atRule && c == ',' && parenDepth == 0:
+			global = false
+		case inSelector() && !atRule && c == '.' && globalDepth == 0 && !global:
+			if n := cssIdentLength(src[i+1:]); n > 0 {
+				name := src[i+1 : i+1+n]
+				scoped := name + "_" + suffix
+				classes[name] = scoped
+				out.WriteString("." + scoped)
+				i += 1 + n
+				continue
+			}
+		}
+		out.WriteByte(c)
+		i++
+	}
+	return out.String(), classes
+}
+
+// isBareGlobal reports whether s starts with :global without parentheses.
+func isBareGlobal(s string) bool {
+	if !strings.HasPrefix(s, ":global") {
+		return false
+	}
+	rest := s[len(":global"):]
+	// Rather than a longer name, such as :global-foo.
+	return rest == "" || rest[0] != '(' && cssIdentLength("x"+rest[:1]) == 1
+}
+
+// atRuleName returns the name of the at-rule whose block opens at src[end].
+func atRuleName(src string, end int) string {
+	start := strings.LastIndexByte(src[:end], '@')
+	if start < 0 {
+		return ""
+	}
+	n := cssIdentLength(src[start+1 : end])
+	return strings.ToLower(src[start+1 : start+1+n])
+}
+
+func isCSSSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f'
+}
+
+// cssIdentLength returns the length of the CSS identifier at the start of s,
+// or 0 if s does not start with one.
+func cssIdentLength(s string) int {
+	isStart := func(c byte) bool {
+		return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= 0x80
+	}
+	i := 0
+	if i < len(s) && s[i] == '-' {
+		i++
+	}
+	if i >= len(s) || !(isStart(s[i]) || s[i] == '-') {
+		return 0
+	}
+	for i < len(s) {
+		c := s[i]
+		if !(isStart(c) || c == '-' || c >= '0' && c <= '9') {
+			break
+		}
+		i++
+	}
+	return i
+}
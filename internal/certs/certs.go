@@ -0,0 +1,191 @@
+// Package certs generates the certificates used to serve projects over
+// HTTPS locally. A certificate authority is created once and cached, so that
+// it only needs to be trusted once per machine, and server certificates are
+// issued by it for the names the server is reachable at.
+package certs
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	caFile     = "ca.pem"
+	caKeyFile  = "ca-key.pem"
+	certFile   = "cert.pem"
+	keyFile    = "key.pem"
+	caLifetime = 10 * 365 * 24 * time.Hour
+	// Browsers reject server certificates valid for more than 825 days.
+	certLifetime = 800 * 24 * time.Hour
+	// Server certificates are renewed when they're about to expire.
+	renewBefore = 30 * 24 * time.Hour
+)
+
+// Result is a server certificate issued by the local certificate authority.
+type Result struct {
+	Certificate tls.Certificate
+	// CAFile is the certificate of the authority, which must be trusted by
+	// browsers for them to accept the server certificate.
+	CAFile string
+	// CACreated is set when the authority was created by this call, and so
+	// isn't trusted yet.
+	CACreated bool
+}
+
+// Dir returns the directory certificates are cached in.
+func Dir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "pack", "certs")
+}
+
+// Local returns a server certificate for hosts, which are host names or IP
+// addresses. The certificate cached in dir is reused if it covers all of
+// them and isn't about to expire. Otherwise a new one is issued.
+func Local(dir string, hosts []string) (Result, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return Result{}, err
+	}
+	ca, caKey, created, err := loadCA(dir)
+	if err != nil {
+		return Result{}, err
+	}
+	result := Result{CAFile: filepath.Join(dir, caFile), CACreated: created}
+
+	if !created {
+		cert, err := tls.LoadX509KeyPair(filepath.Join(dir, certFile), filepath.Join(dir, keyFile))
+		if err == nil && covers(cert, ca, hosts) {
+			result.Certificate = cert
+			return result, nil
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return Result{}, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serialNumber(),
+		Subject:      pkix.Name{Organization: []string{"pack development certificate"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(certLifetime),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, h)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		return Result{}, err
+	}
+	if err := writePEM(filepath.Join(dir, certFile), filepath.Join(dir, keyFile), der, key); err != nil {
+		return Result{}, err
+	}
+	result.Certificate, err = tls.LoadX509KeyPair(filepath.Join(dir, certFile), filepath.Join(dir, keyFile))
+	return result, err
+}
+
+// loadCA reads the certificate authority cached in dir, or creates it.
+func loadCA(dir string) (*x509.Certificate, crypto.Signer, bool, error) {
+	pair, err := tls.LoadX509KeyPair(filepath.Join(dir, caFile), filepath.Join(dir, caKeyFile))
+	if err == nil {
+		ca, err := x509.ParseCertificate(pair.Certificate[0])
+		if err == nil && time.Now().Before(ca.NotAfter) {
+			if key, ok := pair.PrivateKey.(crypto.Signer); ok {
+				return ca, key, false, nil
+			}
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, nil, false, fmt.Errorf("failed to load the local certificate authority: %w", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	hostname, _ := os.Hostname()
+	template := &x509.Certificate{
+		SerialNumber: serialNumber(),
+		Subject: pkix.Name{
+			Organization: []string{"pack development CA"},
+			CommonName:   "pack development CA " + hostname,
+		},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(caLifetime),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	if err := writePEM(filepath.Join(dir, caFile), filepath.Join(dir, caKeyFile), der, key); err != nil {
+		return nil, nil, false, err
+	}
+	// Issued certificates can't be verified against the new authority.
+	os.Remove(filepath.Join(dir, certFile))
+	os.Remove(filepath.Join(dir, keyFile))
+	ca, err := x509.ParseCertificate(der)
+	return ca, key, true, err
+}
+
+// covers reports whether cert was issued by ca for all of hosts, and is
+// valid for a while longer.
+func covers(cert tls.Certificate, ca *x509.Certificate, hosts []string) bool {
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil || time.Now().Add(renewBefore).After(leaf.NotAfter) {
+		return false
+	}
+	if leaf.CheckSignatureFrom(ca) != nil {
+		return false
+	}
+	for _, h := range hosts {
+		if leaf.VerifyHostname(h) != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// writePEM writes a certificate and its private key. The key is only
+// readable by the current user.
+func writePEM(certPath string, keyPath string, der []byte, key *ecdsa.PrivateKey) error {
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
+
+func serialNumber() *big.Int {
+	limit := new(big.Int).Lsh(big.NewInt(1), 128)
+	n, _ := rand.Int(rand.Reader, limit)
+	return n
+}
@@ -0,0 +1,100 @@
+package compress
+
+import (
+	"bytes"
+	"compress/gzip"
+	"mime"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+type Encoding struct {
+	// Name is the value of the Content-Encoding header.
+	Name string
+	// Ext is the extension of precompressed files, e.g. ".gz".
+	Ext      string
+	Compress func(data []byte) ([]byte, error)
+}
+
+var Brotli = Encoding{
+	Name: "br",
+	Ext:  ".br",
+	Compress: func(data []byte) ([]byte, error) {
+		var buf bytes.Buffer
+		w := brotli.NewWriterLevel(&buf, brotli.BestCompression)
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	},
+}
+
+var Gzip = Encoding{
+	Name: "gzip",
+	Ext:  ".gz",
+	Compress: func(data []byte) ([]byte, error) {
+		var buf bytes.Buffer
+		w, err := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	},
+}
+
+// Encodings lists the supported encodings in order of preference.
+var Encodings = []Encoding{Brotli, Gzip}
+
+// Compressible reports whether a file is worth compressing based on its
+// type. Images, fonts, archives and media are already compressed.
+func Compressible(name string) bool {
+	switch strings.ToLower(path.Ext(name)) {
+	case ".js", ".mjs", ".css", ".html", ".htm", ".json", ".map", ".svg",
+		".xml", ".txt", ".md", ".csv", ".wasm", ".webmanifest", ".ico":
+		return true
+	}
+	t := mime.TypeByExtension(path.Ext(name))
+	return strings.HasPrefix(t, "text/")
+}
+
+// Accepted returns the supported encodings that a client accepts according
+// to its Accept-Encoding header, in order of preference.
+func Accepted(acceptEncoding string) []Encoding {
+	accepted := map[string]bool{}
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		fields := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(fields[0]))
+		ok := true
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				q, err := strconv.ParseFloat(param[2:], 64)
+				ok = err != nil || q > 0
+			}
+		}
+		accepted[name] = ok
+	}
+	encodings := []Encoding{}
+	for _, enc := range Encodings {
+		ok, found := accepted[enc.Name]
+		if !found {
+			ok = accepted["*"]
+		}
+		if ok {
+			encodings = append(encodings, enc)
+		}
+	}
+	return encodings
+}
@@ -0,0 +1,298 @@
+// Package coverage maps the V8 coverage of bundled code back to the original
+// sources, through the bundles' source maps.
+//
+// Node writes V8 coverage to the directory in NODE_V8_COVERAGE when it exits.
+// It counts how many times each range of a script ran, in offsets of the
+// generated code. Every mapping of the source map is looked up in those
+// ranges: an original line is covered if any code generated from it ran.
+package coverage
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Coverage is the line and function coverage of a set of source files.
+type Coverage struct {
+	Files []File
+}
+
+// File is the coverage of a source file.
+type File struct {
+	Path string
+	// Lines maps the lines (1-based) that have code to the number of times
+	// they ran.
+	Lines     map[int]int
+	Functions []Function
+}
+
+// Function is the coverage of a function.
+type Function struct {
+	Name string
+	Line int
+	Hits int
+}
+
+// Summary counts what was found and covered.
+type Summary struct {
+	LinesFound     int
+	LinesHit       int
+	FunctionsFound int
+	FunctionsHit   int
+}
+
+// Summary counts the lines and functions of the file.
+func (f File) Summary() Summary {
+	s := Summary{LinesFound: len(f.Lines), FunctionsFound: len(f.Functions)}
+	for _, hits := range f.Lines {
+		if hits > 0 {
+			s.LinesHit++
+		}
+	}
+	for _, fn := range f.Functions {
+		if fn.Hits > 0 {
+			s.FunctionsHit++
+		}
+	}
+	return s
+}
+
+// Summary counts the lines and functions of every file.
+func (c Coverage) Summary() Summary {
+	total := Summary{}
+	for _, f := range c.Files {
+		s := f.Summary()
+		total.LinesFound += s.LinesFound
+		total.LinesHit += s.LinesHit
+		total.FunctionsFound += s.FunctionsFound
+		total.FunctionsHit += s.FunctionsHit
+	}
+	return total
+}
+
+// Lines is the percentage of lines that ran. Nothing to run is 100%.
+func (s Summary) Lines() float64 {
+	return percent(s.LinesHit, s.LinesFound)
+}
+
+// Functions is the percentage of functions that ran.
+func (s Summary) Functions() float64 {
+	return percent(s.FunctionsHit, s.FunctionsFound)
+}
+
+func percent(hit int, found int) float64 {
+	if found == 0 {
+		return 100
+	}
+	return float64(hit) * 100 / float64(found)
+}
+
+// Script is a bundle that ran, with its source map.
+type Script struct {
+	Code      []byte
+	SourceMap []byte
+}
+
+type v8Coverage struct {
+	Result []struct {
+		URL       string `json:"url"`
+		Functions []struct {
+			FunctionName string    `json:"functionName"`
+			Ranges       []v8Range `json:"ranges"`
+		} `json:"functions"`
+	} `json:"result"`
+}
+
+type v8Range struct {
+	StartOffset int `json:"startOffset"`
+	EndOffset   int `json:"endOffset"`
+	Count       int `json:"count"`
+}
+
+// FromV8 reads the coverage files node wrote to dir, for the scripts keyed
+// by path. Only the sources for which include returns true are reported.
+// Sources that are part of several scripts have their counts added up.
+func FromV8(dir string, scripts map[string]Script, include func(source string) bool) (Coverage, error) {
+	files := map[string]*File{}
+	functions := map[string]map[string]*Function{}
+
+	infos, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return Coverage{Files: []File{}}, nil
+	}
+	if err != nil {
+		return Coverage{}, err
+	}
+	for _, info := range infos {
+		if filepath.Ext(info.Name()) != ".json" {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, info.Name()))
+		if err != nil {
+			return Coverage{}, err
+		}
+		var raw v8Coverage
+		if err := json.Unmarshal(data, &raw); err != nil {
+			return Coverage{}, err
+		}
+		for _, result := range raw.Result {
+			u, err := url.Parse(result.URL)
+			if err != nil || u.Scheme != "file" {
+				continue
+			}
+			script, ok := scripts[filepath.FromSlash(u.Path)]
+			if !ok {
+				continue
+			}
+			m, err := parseSourceMap(script.SourceMap)
+			if err != nil {
+				continue
+			}
+			lineStarts := utf16LineStarts(script.Code)
+			size := lineStarts[len(lineStarts)-1]
+
+			// Ranges are nested: the count of an offset is the one of the
+			// innermost range around it. Painting the ranges from the largest
+			// to the smallest leaves every offset with that count.
+			ranges := []v8Range{}
+			for _, fn := range result.Functions {
+				ranges = append(ranges, fn.Ranges...)
+			}
+			sort.SliceStable(ranges, func(i, j int) bool {
+				return ranges[i].EndOffset-ranges[i].StartOffset > ranges[j].EndOffset-ranges[j].StartOffset
+			})
+			counts := make([]int32, size+1)
+			for _, r := range ranges {
+				end := r.EndOffset
+				if end > size {
+					end = size
+				}
+				for i := r.StartOffset; i < end; i++ {
+					counts[i] = int32(r.Count)
+				}
+			}
+
+			// Line hits within this script. A line generated from several
+			// places counts as ran if any of them did.
+			hits := map[string]map[int]int{}
+			for genLine, segments := range m.mappings {
+				if genLine+1 >= len(lineStarts) {
+					break
+				}
+				for _, seg := range segments {
+					source := m.sources[seg.source]
+					if !include(source) {
+						continue
+					}
+					offset := lineStarts[genLine] + seg.genColumn
+					if offset > size {
+						continue
+					}
+					if hits[source] == nil {
+						hits[source] = map[int]int{}
+					}
+					line := seg.origLine + 1
+					if n, ok := hits[source][line]; !ok || int(counts[offset]) > n {
+						hits[source][line] = int(counts[offset])
+					}
+				}
+			}
+			for source, lines := range hits {
+				f := files[source]
+				if f == nil {
+					f = &File{Path: source, Lines: map[int]int{}}
+					files[source] = f
+					functions[source] = map[string]*Function{}
+				}
+				for line, n := range lines {
+					f.Lines[line] += n
+				}
+			}
+
+			for _, fn := range result.Functions {
+				if len(fn.Ranges) == 0 || (fn.FunctionName == "" && fn.Ranges[0].StartOffset == 0) {
+					// The script itself.
+					continue
+				}
+				genLine, genColumn := position(lineStarts, fn.Ranges[0].StartOffset)
+				seg, ok := m.lookup(genLine, genColumn)
+				if !ok {
+					continue
+				}
+				source := m.sources[seg.source]
+				if !include(source) || files[source] == nil {
+					continue
+				}
+				name := fn.FunctionName
+				if name == "" {
+					name = "(anonymous)"
+				}
+				key := fmt.Sprintf("%s@%d", name, seg.origLine)
+				f := functions[source][key]
+				if f == nil {
+					f = &Function{Name: name, Line: seg.origLine + 1}
+					functions[source][key] = f
+				}
+				f.Hits += fn.Ranges[0].Count
+			}
+		}
+	}
+
+	c := Coverage{Files: []File{}}
+	for source, f := range files {
+		for _, fn := range functions[source] {
+			f.Functions = append(f.Functions, *fn)
+		}
+		sort.Slice(f.Functions, func(i, j int) bool {
+			a, b := f.Functions[i], f.Functions[j]
+			return a.Line < b.Line || (a.Line == b.Line && a.Name < b.Name)
+		})
+		c.Files = append(c.Files, *f)
+	}
+	sort.Slice(c.Files, func(i, j int) bool { return c.Files[i].Path < c.Files[j].Path })
+	return c, nil
+}
+
+// utf16LineStarts returns the offsets, in UTF-16 code units as used by V8 and
+// source maps, at which each line of code starts. The last element is the
+// length of the code.
+func utf16LineStarts(code []byte) []int {
+	starts := []int{0}
+	offset := 0
+	for _, r := range string(code) {
+		offset++
+		if r >= 0x10000 {
+			// A surrogate pair.
+			offset++
+		}
+		if r == '\n' {
+			starts = append(starts, offset)
+		}
+	}
+	return append(starts, offset)
+}
+
+// position converts an offset to a line and column.
+func position(lineStarts []int, offset int) (int, int) {
+	line := sort.Search(len(lineStarts)-1, func(i int) bool { return lineStarts[i] > offset }) - 1
+	if line < 0 {
+		line = 0
+	}
+	return line, offset - lineStarts[line]
+}
+
+// IsSource reports whether path is a source file of the project in root,
+// rather than a dependency or a test.
+func IsSource(root string, path string, isTest func(string) bool) bool {
+	rel, err := filepath.Rel(root, path)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return false
+	}
+	return !strings.Contains(filepath.ToSlash(rel), "node_modules/") && !isTest(path)
+}
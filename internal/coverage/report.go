@@ -0,0 +1,214 @@
+package coverage
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// WriteText writes a summary table of the coverage, with the uncovered lines
+// of each file. Paths are shown relative to root.
+func WriteText(w io.Writer, c Coverage, root string) error {
+	fmt.Fprintf(w, "%-40s %8s %10s  %s\n", "File", "Lines", "Functions", "Uncovered lines")
+	for _, f := range c.Files {
+		s := f.Summary()
+		fmt.Fprintf(w, "%-40s %7.1f%% %9.1f%%  %s\n", relative(root, f.Path), s.Lines(), s.Functions(), uncovered(f))
+	}
+	s := c.Summary()
+	_, err := fmt.Fprintf(w, "%-40s %7.1f%% %9.1f%%\n", "All files", s.Lines(), s.Functions())
+	return err
+}
+
+// uncovered lists the lines of a file that didn't run, as ranges such as
+// "3-5, 9".
+func uncovered(f File) string {
+	lines := []int{}
+	for line, hits := range f.Lines {
+		if hits == 0 {
+			lines = append(lines, line)
+		}
+	}
+	sort.Ints(lines)
+	ranges := []string{}
+	for i := 0; i < len(lines); {
+		j := i
+		for j+1 < len(lines) && lines[j+1] == lines[j]+1 {
+			j++
+		}
+		if i == j {
+			ranges = append(ranges, fmt.Sprint(lines[i]))
+		} else {
+			ranges = append(ranges, fmt.Sprintf("%d-%d", lines[i], lines[j]))
+		}
+		i = j + 1
+	}
+	return strings.Join(ranges, ", ")
+}
+
+// WriteLCOV writes the coverage in the lcov tracefile format, which most
+// coverage services and editors read.
+func WriteLCOV(w io.Writer, c Coverage) error {
+	var b strings.Builder
+	for _, f := range c.Files {
+		s := f.Summary()
+		fmt.Fprintf(&b, "TN:\nSF:%s\n", f.Path)
+		for _, fn := range f.Functions {
+			fmt.Fprintf(&b, "FN:%d,%s\n", fn.Line, fn.Name)
+		}
+		for _, fn := range f.Functions {
+			fmt.Fprintf(&b, "FNDA:%d,%s\n", fn.Hits, fn.Name)
+		}
+		fmt.Fprintf(&b, "FNF:%d\nFNH:%d\n", s.FunctionsFound, s.FunctionsHit)
+		lines := make([]int, 0, len(f.Lines))
+		for line := range f.Lines {
+			lines = append(lines, line)
+		}
+		sort.Ints(lines)
+		for _, line := range lines {
+			fmt.Fprintf(&b, "DA:%d,%d\n", line, f.Lines[line])
+		}
+		fmt.Fprintf(&b, "LF:%d\nLH:%d\nend_of_record\n", s.LinesFound, s.LinesHit)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// WriteHTML writes an HTML report to dir: an index of the files, and a page
+// for each file with its lines highlighted by whether they ran.
+func WriteHTML(dir string, c Coverage, root string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	type row struct {
+		Path    string
+		Page    string
+		Summary Summary
+	}
+	rows := []row{}
+	for _, f := range c.Files {
+		rel := relative(root, f.Path)
+		page := strings.NewReplacer("/", "_", "\\", "_").Replace(rel) + ".html"
+		rows = append(rows, row{Path: rel, Page: page, Summary: f.Summary()})
+		if err := writeHTMLFile(filepath.Join(dir, page), f, rel); err != nil {
+			return err
+		}
+	}
+	out, err := os.Create(filepath.Join(dir, "index.html"))
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	return indexPage.Execute(out, struct {
+		Rows  []row
+		Total Summary
+	}{rows, c.Summary()})
+}
+
+type htmlLine struct {
+	Number int
+	Text   string
+	// Class is "hit", "miss", or empty for lines without code.
+	Class string
+	Hits  int
+}
+
+func writeHTMLFile(path string, f File, rel string) error {
+	data, err := ioutil.ReadFile(f.Path)
+	if err != nil {
+		return err
+	}
+	lines := []htmlLine{}
+	for i, text := range strings.Split(strings.TrimRight(string(data), "\n"), "\n") {
+		line := htmlLine{Number: i + 1, Text: text}
+		if hits, ok := f.Lines[i+1]; ok {
+			line.Hits = hits
+			line.Class = "miss"
+			if hits > 0 {
+				line.Class = "hit"
+			}
+		}
+		lines = append(lines, line)
+	}
+	out, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	return filePage.Execute(out, struct {
+		Path    string
+		Summary Summary
+		Lines   []htmlLine
+	}{rel, f.Summary(), lines})
+}
+
+func relative(root string, path string) string {
+	if abs, err := filepath.Abs(root); err == nil {
+		root = abs
+	}
+	if rel, err := filepath.Rel(root, path); err == nil && !strings.HasPrefix(rel, "..") {
+		return filepath.ToSlash(rel)
+	}
+	return path
+}
+
+const pageStyle = `<style>
+  body { font: 14px/1.5 system-ui, sans-serif; margin: 2em; color: #222; }
+  table { border-collapse: collapse; }
+  td, th { text-align: left; padding: .25em .75em; border-bottom: 1px solid #eee; }
+  td.pct { text-align: right; font-variant-numeric: tabular-nums; }
+  pre { font: 13px ui-monospace, monospace; margin: 0; }
+  .code td { padding: 0 .75em; border: 0; vertical-align: top; }
+  .code .n, .code .h { color: #999; text-align: right; user-select: none; }
+  .hit { background: #e6ffed; }
+  .miss { background: #ffeef0; }
+</style>`
+
+var indexPage = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Coverage</title>
+` + pageStyle + `
+</head>
+<body>
+<h1>Coverage</h1>
+<table>
+<tr><th>File</th><th>Lines</th><th>Functions</th></tr>
+{{range .Rows}}<tr>
+  <td><a href="{{.Page}}">{{.Path}}</a></td>
+  <td class="pct">{{printf "%.1f" .Summary.Lines}}% ({{.Summary.LinesHit}}/{{.Summary.LinesFound}})</td>
+  <td class="pct">{{printf "%.1f" .Summary.Functions}}% ({{.Summary.FunctionsHit}}/{{.Summary.FunctionsFound}})</td>
+</tr>
+{{end}}<tr>
+  <th>All files</th>
+  <th class="pct">{{printf "%.1f" .Total.Lines}}% ({{.Total.LinesHit}}/{{.Total.LinesFound}})</th>
+  <th class="pct">{{printf "%.1f" .Total.Functions}}% ({{.Total.FunctionsHit}}/{{.Total.FunctionsFound}})</th>
+</tr>
+</table>
+</body>
+</html>
+`))
+
+var filePage = template.Must(template.New("file").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Path}} - Coverage</title>
+` + pageStyle + `
+</head>
+<body>
+<p><a href="index.html">All files</a></p>
+<h1>{{.Path}}</h1>
+<p>Lines: {{printf "%.1f" .Summary.Lines}}% ({{.Summary.LinesHit}}/{{.Summary.LinesFound}}),
+functions: {{printf "%.1f" .Summary.Functions}}% ({{.Summary.FunctionsHit}}/{{.Summary.FunctionsFound}})</p>
+<table class="code">
+{{range .Lines}}<tr class="{{.Class}}"><td class="n">{{.Number}}</td><td class="h">{{if .Class}}{{.Hits}}x{{end}}</td><td><pre>{{.Text}}</pre></td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
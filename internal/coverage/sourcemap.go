@@ -0,0 +1,111 @@
+package coverage
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// sourceMap is a decoded source map, version 3.
+type sourceMap struct {
+	sources []string
+	// mappings holds the segments of each generated line, by column.
+	mappings [][]segment
+}
+
+type segment struct {
+	genColumn int
+	source    int
+	origLine  int
+	origCol   int
+}
+
+func parseSourceMap(data []byte) (sourceMap, error) {
+	var raw struct {
+		Version  int      `json:"version"`
+		Sources  []string `json:"sources"`
+		Mappings string   `json:"mappings"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return sourceMap{}, err
+	}
+	if raw.Version != 3 {
+		return sourceMap{}, fmt.Errorf("unsupported source map version %d", raw.Version)
+	}
+	m := sourceMap{sources: raw.Sources}
+
+	// Fields other than the generated column are relative to the previous
+	// segment, across lines.
+	source, origLine, origCol := 0, 0, 0
+	for _, line := range strings.Split(raw.Mappings, ";") {
+		segments := []segment{}
+		genColumn := 0
+		for _, field := range strings.Split(line, ",") {
+			if field == "" {
+				continue
+			}
+			values, err := decodeVLQ(field)
+			if err != nil {
+				return sourceMap{}, err
+			}
+			genColumn += values[0]
+			if len(values) < 4 {
+				// Generated code that doesn't come from a source.
+				continue
+			}
+			source += values[1]
+			origLine += values[2]
+			origCol += values[3]
+			if source < 0 || source >= len(m.sources) {
+				return sourceMap{}, fmt.Errorf("invalid source index %d", source)
+			}
+			segments = append(segments, segment{genColumn, source, origLine, origCol})
+		}
+		m.mappings = append(m.mappings, segments)
+	}
+	return m, nil
+}
+
+// lookup returns the segment that generated the code at a position: the
+// last one on the line that starts at or before the column.
+func (m sourceMap) lookup(genLine int, genColumn int) (segment, bool) {
+	if genLine >= len(m.mappings) {
+		return segment{}, false
+	}
+	segments := m.mappings[genLine]
+	i := sort.Search(len(segments), func(i int) bool { return segments[i].genColumn > genColumn })
+	if i == 0 {
+		return segment{}, false
+	}
+	return segments[i-1], true
+}
+
+const base64Chars = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/"
+
+// decodeVLQ decodes the base64 VLQ values of a segment.
+func decodeVLQ(s string) ([]int, error) {
+	values := []int{}
+	value, shift := 0, 0
+	for i := 0; i < len(s); i++ {
+		digit := strings.IndexByte(base64Chars, s[i])
+		if digit < 0 {
+			return nil, fmt.Errorf("invalid character %q in source map", s[i])
+		}
+		value += (digit & 31) << shift
+		if digit&32 != 0 {
+			shift += 5
+			continue
+		}
+		if value&1 != 0 {
+			values = append(values, -(value >> 1))
+		} else {
+			values = append(values, value>>1)
+		}
+		value, shift = 0, 0
+	}
+	if shift != 0 {
+		return nil, fmt.Errorf("truncated segment %q in source map", s)
+	}
+	return values, nil
+}
@@ -0,0 +1,159 @@
+package coverage
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	esbuild "github.com/evanw/esbuild/pkg/api"
+)
+
+var loaders = map[string]esbuild.Loader{
+	".js":  esbuild.LoaderJS,
+	".jsx": esbuild.LoaderJSX,
+	".ts":  esbuild.LoaderTS,
+	".tsx": esbuild.LoaderTSX,
+}
+
+// IsScript reports whether path is a file coverage can be collected for.
+func IsScript(path string) bool {
+	_, ok := loaders[filepath.Ext(path)]
+	return ok && !strings.HasSuffix(path, ".d.ts")
+}
+
+// AddSources adds the lines with code and the functions of every file in
+// paths to c, as ones that didn't run unless c already has them. Bundles
+// leave out the code that isn't imported, so without this, a file would look
+// fully covered when only the functions its tests use were bundled, and files
+// that no test imports wouldn't be reported at all.
+//
+// Each file is transformed on its own, so nothing is left out, and the lines
+// that generate code are read from the source map. Functions are found in
+// the transformed code, and only added on lines where c has none, since V8
+// may name them differently.
+func (c *Coverage) AddSources(paths []string) error {
+	files := map[string]int{}
+	for i, f := range c.Files {
+		files[f.Path] = i
+	}
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		result := esbuild.Transform(string(data), esbuild.TransformOptions{
+			Loader:     loaders[filepath.Ext(path)],
+			Sourcefile: path,
+			Sourcemap:  esbuild.SourceMapExternal,
+			LogLevel:   esbuild.LogLevelSilent,
+		})
+		if len(result.Errors) > 0 {
+			// Bundling reports syntax errors already.
+			continue
+		}
+		m, err := parseSourceMap(result.Map)
+		if err != nil {
+			continue
+		}
+		i, ok := files[path]
+		if !ok {
+			c.Files = append(c.Files, File{Path: path, Lines: map[int]int{}, Functions: []Function{}})
+			i = len(c.Files) - 1
+			files[path] = i
+		}
+		for _, segments := range m.mappings {
+			for _, seg := range segments {
+				if _, ok := c.Files[i].Lines[seg.origLine+1]; !ok {
+					c.Files[i].Lines[seg.origLine+1] = 0
+				}
+			}
+		}
+
+		f := &c.Files[i]
+		covered := map[int]bool{}
+		for _, fn := range f.Functions {
+			covered[fn.Line] = true
+		}
+		for _, fn := range findFunctions(result.Code, m) {
+			if !covered[fn.Line] {
+				f.Functions = append(f.Functions, fn)
+			}
+		}
+		sort.Slice(f.Functions, func(i, j int) bool {
+			a, b := f.Functions[i], f.Functions[j]
+			return a.Line < b.Line || (a.Line == b.Line && a.Name < b.Name)
+		})
+	}
+	sort.Slice(c.Files, func(i, j int) bool { return c.Files[i].Path < c.Files[j].Path })
+	return nil
+}
+
+var (
+	// functionPattern matches function declarations and expressions.
+	functionPattern = regexp.MustCompile(`\b(?:async\s+)?function\b\s*\*?\s*([\w$]*)\s*\(`)
+	// arrowPattern matches arrow functions, along with the name of the
+	// variable or property they're assigned to, if any.
+	arrowPattern = regexp.MustCompile(`(?:([\w$]+)\s*[=:]\s*)?(?:async\s*)?(?:\([^()]*\)|[\w$]+)\s*=>`)
+	// methodPattern matches the methods of classes and object literals,
+	// which esbuild puts on lines of their own.
+	methodPattern = regexp.MustCompile(`(?m)^[ \t]*(?:static\s+)?(?:async\s+)?(?:[gs]et\s+)?\*?([\w$]+)\s*\([^()]*\)\s*\{`)
+)
+
+// keywords are the statements that look like methods to methodPattern.
+var keywords = map[string]bool{
+	"if": true, "for": true, "while": true, "switch": true, "catch": true, "with": true, "function": true, "return": true,
+}
+
+// findFunctions finds the functions in code, which was generated by esbuild,
+// and maps them to the lines of the source they come from. Good enough for
+// the code esbuild prints, rather than a full parser.
+func findFunctions(code []byte, m sourceMap) []Function {
+	type match struct {
+		offset int
+		name   string
+	}
+	matches := []match{}
+	for _, pattern := range []*regexp.Regexp{functionPattern, arrowPattern, methodPattern} {
+		for _, loc := range pattern.FindAllSubmatchIndex(code, -1) {
+			name := ""
+			if loc[2] >= 0 {
+				name = string(code[loc[2]:loc[3]])
+			}
+			if pattern == methodPattern && keywords[name] {
+				continue
+			}
+			// The end of the match is mapped, since leading whitespace isn't.
+			matches = append(matches, match{offset: loc[1] - 1, name: name})
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i].offset < matches[j].offset })
+
+	// Source maps count columns in UTF-16 code units.
+	functions := []Function{}
+	line, column, offset := 0, 0, 0
+	for _, match := range matches {
+		for _, r := range string(code[offset:match.offset]) {
+			switch {
+			case r == '\n':
+				line, column = line+1, 0
+			case r >= 0x10000:
+				column += 2
+			default:
+				column++
+			}
+		}
+		offset = match.offset
+		seg, ok := m.lookup(line, column)
+		if !ok {
+			continue
+		}
+		name := match.name
+		if name == "" {
+			name = "(anonymous)"
+		}
+		functions = append(functions, Function{Name: name, Line: seg.origLine + 1})
+	}
+	return functions
+}
@@ -24,7 +24,16 @@ type Message struct {
 }
 
 type MessageData struct {
-	Text string
+	Text     string
+	Location *MessageLocation
+}
+
+// MessageLocation is where in a file a message points to. Line and Column
+// are 1-based.
+type MessageLocation struct {
+	File   string
+	Line   int
+	Column int
 }
 
 func (kind MessageKind) String() string {
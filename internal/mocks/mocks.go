@@ -0,0 +1,182 @@
+// Package mocks reads mock API responses for the development server.
+//
+// Every .json file at the top of the mocks directory maps routes to
+// responses:
+//
+//	{
+//	  "GET /api/users/:id": {
+//	    "status": 200,
+//	    "headers": {"X-Total-Count": "1"},
+//	    "body": {"id": 1, "name": "Ada"},
+//	    "delay": 300
+//	  },
+//	  "POST /api/users": {"status": 201, "bodyFile": "data/user.json"},
+//	  "/api/legacy/*": {"status": 410, "enabled": false}
+//	}
+//
+// Routes without a method match any method. Paths use the same patterns as
+// _redirects rules (:placeholders and * splats). Body files are kept in
+// subdirectories, which aren't read for mocks.
+package mocks
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/davezuko/pack/internal/rules"
+)
+
+// Route is a mocked endpoint.
+type Route struct {
+	// File is the mock file the route is declared in, and Key the route as
+	// written in it, e.g. "GET /api/users/:id".
+	File string
+	Key  string
+
+	Method  string
+	Path    string
+	Status  int
+	Headers map[string]string
+	// Body is the response body. JSON strings are sent as-is, other values
+	// are sent as JSON.
+	Body json.RawMessage
+	// BodyFile is a file, relative to the mock file, whose contents are sent
+	// as the body.
+	BodyFile string
+	Delay    time.Duration
+	Enabled  bool
+
+	pattern rules.Pattern
+}
+
+// ID identifies the route across reloads, e.g. to toggle it.
+func (r Route) ID() string {
+	return r.File + ": " + r.Key
+}
+
+type routeJSON struct {
+	Status   int               `json:"status"`
+	Headers  map[string]string `json:"headers"`
+	Body     json.RawMessage   `json:"body"`
+	BodyFile string            `json:"bodyFile"`
+	Delay    int               `json:"delay"`
+	Enabled  *bool             `json:"enabled"`
+}
+
+// Load reads the mocks in dir. Routes are returned in file name order, and
+// in the order they are written within a file. A missing dir has no mocks.
+func Load(dir string) ([]Route, []error) {
+	routes := []Route{}
+	errors := []error{}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		errors = append(errors, err)
+	}
+	for _, info := range infos {
+		if !info.Mode().IsRegular() || filepath.Ext(info.Name()) != ".json" {
+			continue
+		}
+		file := filepath.Join(dir, info.Name())
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			errors = append(errors, err)
+			continue
+		}
+		keys, err := orderedKeys(data)
+		if err != nil {
+			errors = append(errors, fmt.Errorf("%s: %w", file, err))
+			continue
+		}
+		var raw map[string]routeJSON
+		if err := json.Unmarshal(data, &raw); err != nil {
+			errors = append(errors, fmt.Errorf("%s: %w", file, err))
+			continue
+		}
+		for _, key := range keys {
+			r, err := newRoute(file, key, raw[key])
+			if err != nil {
+				errors = append(errors, fmt.Errorf("%s: %q: %w", file, key, err))
+				continue
+			}
+			routes = append(routes, r)
+		}
+	}
+	return routes, errors
+}
+
+func newRoute(file string, key string, raw routeJSON) (Route, error) {
+	r := Route{
+		File:     file,
+		Key:      key,
+		Status:   raw.Status,
+		Headers:  raw.Headers,
+		Body:     raw.Body,
+		BodyFile: raw.BodyFile,
+		Delay:    time.Duration(raw.Delay) * time.Millisecond,
+		Enabled:  raw.Enabled == nil || *raw.Enabled,
+	}
+	fields := strings.Fields(key)
+	switch len(fields) {
+	case 1:
+		r.Path = fields[0]
+	case 2:
+		r.Method, r.Path = strings.ToUpper(fields[0]), fields[1]
+	default:
+		return r, fmt.Errorf("expected \"[METHOD] /path\"")
+	}
+	if !strings.HasPrefix(r.Path, "/") {
+		return r, fmt.Errorf("the path must start with \"/\"")
+	}
+	if r.Status == 0 {
+		r.Status = http.StatusOK
+	}
+	if http.StatusText(r.Status) == "" {
+		return r, fmt.Errorf("invalid status code %d", r.Status)
+	}
+	if r.Body != nil && r.BodyFile != "" {
+		return r, fmt.Errorf("body and bodyFile can't be used together")
+	}
+	if r.BodyFile != "" {
+		r.BodyFile = filepath.Join(filepath.Dir(file), r.BodyFile)
+	}
+	r.pattern = rules.NewPattern(r.Path)
+	return r, nil
+}
+
+// Match reports whether the route answers req.
+func (r Route) Match(req *http.Request) bool {
+	if r.Method != "" && r.Method != req.Method {
+		return false
+	}
+	_, ok := r.pattern.Match(req.URL.Path)
+	return ok
+}
+
+// orderedKeys returns the keys of a JSON object in the order they appear,
+// which encoding/json doesn't preserve.
+func orderedKeys(data []byte) ([]string, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if t, err := dec.Token(); err != nil || t != json.Delim('{') {
+		return nil, fmt.Errorf("expected an object of routes")
+	}
+	keys := []string{}
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, t.(string))
+		var skip json.RawMessage
+		if err := dec.Decode(&skip); err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
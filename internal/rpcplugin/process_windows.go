@@ -0,0 +1,16 @@
+package rpcplugin
+
+import (
+	"os"
+	"os/exec"
+	"strconv"
+)
+
+// setProcessGroup does nothing on Windows, where killProcessGroup finds the
+// children of the process instead.
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// killProcessGroup kills the process and its children.
+func killProcessGroup(p *os.Process) error {
+	return exec.Command("taskkill", "/T", "/F", "/PID", strconv.Itoa(p.Pid)).Run()
+}
@@ -0,0 +1,474 @@
+// Package rpcplugin runs plugins in processes of their own, so that they can
+// be written in any language. pack talks to a plugin with JSON-RPC 2.0 over
+// its stdin and stdout, one message per line. Plugins log to stderr, which is
+// passed through.
+//
+// The process is started once per build, or once for the lifetime of the
+// development server, and pack first calls "initialize":
+//
+//	{"jsonrpc": "2.0", "id": 1, "method": "initialize", "params": {"mode": "production", "root": "/path/to/project"}}
+//
+// The plugin replies with the hooks it implements. Filters are regular
+// expressions, in Go syntax, that the paths must match:
+//
+//	{"jsonrpc": "2.0", "id": 1, "result": {"onResolve": [{"filter": "^virtual:"}], "onLoad": [{"filter": "\\.yaml$"}], "transformHTML": true}}
+//
+// and is then called for every path that matches one of its filters, or for
+// every html page:
+//
+//	resolve        {"path", "importer", "namespace", "resolveDir"} -> {"path", "namespace", "external"}
+//	load           {"path", "namespace"} -> {"contents", "loader", "resolveDir"}
+//	transformHTML  {"path", "html"} -> {"html"}
+//
+// Results may be null, or leave out "path", "contents" or "html", to pass.
+// They may also have "errors" and "warnings": lists of {"text", "location":
+// {"file", "line", "column"}}, with 1-based lines and columns, which are
+// reported with the build's diagnostics. A JSON-RPC error fails the hook.
+//
+// Calls can be concurrent, and their replies can come in any order. When
+// pack is done with the plugin, it sends the "shutdown" notification (which
+// has no id and expects no reply) and closes stdin. A plugin that exits early,
+// or that doesn't reply to a call in time, is started again on the next call.
+package rpcplugin
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// DefaultTimeout is how long a call may take unless Config.Timeout is set.
+const DefaultTimeout = 10 * time.Second
+
+// Config describes how to run a plugin.
+type Config struct {
+	Name string
+	// Command is the program to run and its arguments.
+	Command []string
+	// Dir is the working directory of the plugin.
+	Dir string
+	// Timeout is how long a call may take before it fails.
+	Timeout time.Duration
+}
+
+// InitializeParams tell a plugin about the build.
+type InitializeParams struct {
+	// Mode is "production" or "development".
+	Mode string `json:"mode"`
+	Root string `json:"root"`
+}
+
+// Capabilities are the hooks a plugin implements.
+type Capabilities struct {
+	OnResolve     []Filter `json:"onResolve"`
+	OnLoad        []Filter `json:"onLoad"`
+	TransformHTML bool     `json:"transformHTML"`
+}
+
+// Filter selects the paths a hook is called for.
+type Filter struct {
+	Filter    string `json:"filter"`
+	Namespace string `json:"namespace,omitempty"`
+}
+
+// Diagnostic is an error or warning reported by a plugin.
+type Diagnostic struct {
+	Text     string    `json:"text"`
+	Location *Location `json:"location,omitempty"`
+}
+
+// Location is where a diagnostic points to. Line and Column are 1-based.
+type Location struct {
+	File   string `json:"file"`
+	Line   int    `json:"line"`
+	Column int    `json:"column"`
+}
+
+// Diagnostics are the errors and warnings that come with a result.
+type Diagnostics struct {
+	Errors   []Diagnostic `json:"errors,omitempty"`
+	Warnings []Diagnostic `json:"warnings,omitempty"`
+}
+
+type ResolveParams struct {
+	Path       string `json:"path"`
+	Importer   string `json:"importer"`
+	Namespace  string `json:"namespace"`
+	ResolveDir string `json:"resolveDir"`
+}
+
+type ResolveResult struct {
+	Path      string `json:"path"`
+	Namespace string `json:"namespace"`
+	External  bool   `json:"external"`
+	Diagnostics
+}
+
+type LoadParams struct {
+	Path      string `json:"path"`
+	Namespace string `json:"namespace"`
+}
+
+type LoadResult struct {
+	Contents *string `json:"contents"`
+	// Loader is the name of an esbuild loader, such as "js" or "css".
+	Loader     string `json:"loader"`
+	ResolveDir string `json:"resolveDir"`
+	Diagnostics
+}
+
+type TransformHTMLParams struct {
+	Path string `json:"path"`
+	HTML string `json:"html"`
+}
+
+type TransformHTMLResult struct {
+	HTML *string `json:"html"`
+	Diagnostics
+}
+
+// Plugin is a running plugin.
+type Plugin struct {
+	config Config
+	init   InitializeParams
+	caps   Capabilities
+
+	mu     sync.Mutex
+	proc   *process
+	closed bool
+}
+
+// Start starts a plugin and initializes it.
+func Start(config Config, init InitializeParams) (*Plugin, error) {
+	if len(config.Command) == 0 {
+		return nil, fmt.Errorf("plugin %q has no command", config.Name)
+	}
+	if config.Timeout == 0 {
+		config.Timeout = DefaultTimeout
+	}
+	p := &Plugin{config: config, init: init}
+	if _, err := p.process(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Capabilities returns the hooks the plugin implements, as it replied to
+// "initialize".
+func (p *Plugin) Capabilities() Capabilities {
+	return p.caps
+}
+
+func (p *Plugin) Resolve(params ResolveParams) (ResolveResult, error) {
+	var result ResolveResult
+	err := p.call("resolve", params, &result)
+	return result, err
+}
+
+func (p *Plugin) Load(params LoadParams) (LoadResult, error) {
+	var result LoadResult
+	err := p.call("load", params, &result)
+	return result, err
+}
+
+func (p *Plugin) TransformHTML(params TransformHTMLParams) (TransformHTMLResult, error) {
+	var result TransformHTMLResult
+	err := p.call("transformHTML", params, &result)
+	return result, err
+}
+
+// Close tells the plugin to shut down, and kills it if it doesn't exit in
+// time.
+func (p *Plugin) Close() error {
+	p.mu.Lock()
+	p.closed = true
+	proc := p.proc
+	p.proc = nil
+	p.mu.Unlock()
+	if proc == nil {
+		return nil
+	}
+	return proc.shutdown()
+}
+
+func (p *Plugin) call(method string, params interface{}, result interface{}) error {
+	proc, err := p.process()
+	if err != nil {
+		return err
+	}
+	return proc.call(method, params, result, p.config.Timeout)
+}
+
+// process returns the plugin's process, starting it if it isn't running.
+func (p *Plugin) process() (*process, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return nil, fmt.Errorf("plugin %q was closed", p.config.Name)
+	}
+	if p.proc != nil && !p.proc.exited() {
+		return p.proc, nil
+	}
+	proc, err := startProcess(p.config)
+	if err != nil {
+		return nil, err
+	}
+	var caps Capabilities
+	if err := proc.call("initialize", p.init, &caps, p.config.Timeout); err != nil {
+		proc.kill()
+		return nil, err
+	}
+	// Hooks are registered with the first reply, so a restarted plugin
+	// keeps the capabilities it started with.
+	if p.proc == nil {
+		p.caps = caps
+	}
+	p.proc = proc
+	return proc, nil
+}
+
+type request struct {
+	JSONRPC string      `json:"jsonrpc"`
+	ID      int64       `json:"id,omitempty"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params,omitempty"`
+}
+
+type response struct {
+	ID     int64           `json:"id"`
+	Result json.RawMessage `json:"result"`
+	Error  *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// process is a running plugin process.
+type process struct {
+	name  string
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+
+	mu      sync.Mutex
+	nextID  int64
+	pending map[int64]chan response
+
+	// writeMu keeps messages from interleaving on stdin.
+	writeMu sync.Mutex
+
+	// done is closed when the process exits.
+	done chan struct{}
+	err  error
+	// killed is closed when the process is killed, which may take a while to
+	// be noticed.
+	killed   chan struct{}
+	killOnce sync.Once
+}
+
+func startProcess(config Config) (*process, error) {
+	cmd := exec.Command(config.Command[0], config.Command[1:]...)
+	cmd.Dir = config.Dir
+	cmd.Stderr = os.Stderr
+	// Commands such as npx or sh -c run the plugin in a child process of
+	// their own, which is killed along with them.
+	setProcessGroup(cmd)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	// Unlike cmd.StdoutPipe, a pipe of our own lets Wait return as soon as
+	// the process exits, even if one of its children still holds stdout.
+	stdout, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	cmd.Stdout = w
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		stdout.Close()
+		return nil, fmt.Errorf("failed to start plugin %q: %w", config.Name, err)
+	}
+	proc := &process{
+		name:    config.Name,
+		cmd:     cmd,
+		stdin:   stdin,
+		pending: map[int64]chan response{},
+		done:    make(chan struct{}),
+		killed:  make(chan struct{}),
+	}
+	read := make(chan struct{})
+	go func() {
+		proc.read(stdout)
+		close(read)
+	}()
+	go proc.wait(stdout, read)
+	return proc, nil
+}
+
+// read dispatches replies to the calls waiting for them, until stdout is
+// closed.
+func (proc *process) read(stdout io.ReadCloser) {
+	defer stdout.Close()
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		var res response
+		if err := json.Unmarshal(line, &res); err != nil || res.ID == 0 {
+			// Not a reply, most likely something the plugin meant to log.
+			fmt.Fprintf(os.Stderr, "[%s] %s\n", proc.name, line)
+			continue
+		}
+		proc.mu.Lock()
+		ch, ok := proc.pending[res.ID]
+		delete(proc.pending, res.ID)
+		proc.mu.Unlock()
+		if ok {
+			ch <- res
+		}
+	}
+}
+
+// drainTimeout is how long the replies a plugin sent before it exited are
+// read for, when one of its children keeps stdout open.
+const drainTimeout = 500 * time.Millisecond
+
+// wait closes proc.done when the process exits, once the reader has handled
+// what the process wrote.
+func (proc *process) wait(stdout io.Closer, read <-chan struct{}) {
+	err := proc.cmd.Wait()
+	select {
+	case <-read:
+	case <-time.After(drainTimeout):
+		stdout.Close()
+	}
+	proc.err = err
+	close(proc.done)
+}
+
+func (proc *process) exited() bool {
+	select {
+	case <-proc.done:
+		return true
+	case <-proc.killed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (proc *process) call(method string, params interface{}, result interface{}, timeout time.Duration) error {
+	ch := make(chan response, 1)
+	proc.mu.Lock()
+	proc.nextID++
+	id := proc.nextID
+	proc.pending[id] = ch
+	proc.mu.Unlock()
+	defer func() {
+		proc.mu.Lock()
+		delete(proc.pending, id)
+		proc.mu.Unlock()
+	}()
+
+	// Writing blocks while the plugin isn't reading its stdin, so it's part
+	// of the call's timeout too.
+	written := make(chan error, 1)
+	go func() {
+		written <- proc.write(request{JSONRPC: "2.0", ID: id, Method: method, Params: params})
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case err := <-written:
+			if err != nil {
+				return fmt.Errorf("failed to call %s: %w", method, err)
+			}
+			written = nil
+		case res := <-ch:
+			if res.Error != nil {
+				return fmt.Errorf("%s failed: %s", method, res.Error.Message)
+			}
+			if len(res.Result) == 0 {
+				return nil
+			}
+			if err := json.Unmarshal(res.Result, result); err != nil {
+				return fmt.Errorf("invalid reply to %s: %w", method, err)
+			}
+			return nil
+		case <-proc.done:
+			status := "exited"
+			if proc.err != nil {
+				status = proc.err.Error()
+			}
+			return fmt.Errorf("the plugin process stopped during %s: %s", method, status)
+		case <-timer.C:
+			// A plugin that doesn't reply in time is most likely stuck. It's
+			// killed, so that the next call starts it again.
+			proc.kill()
+			return fmt.Errorf("%s timed out after %s", method, timeout)
+		}
+	}
+}
+
+func (proc *process) write(req request) error {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	proc.writeMu.Lock()
+	defer proc.writeMu.Unlock()
+	_, err = proc.stdin.Write(append(data, '\n'))
+	return err
+}
+
+// shutdownTimeout is how long a plugin has to exit after being told to.
+const shutdownTimeout = 2 * time.Second
+
+func (proc *process) shutdown() error {
+	// A plugin that doesn't read its stdin would block the notification
+	// forever, so it's written in the background.
+	deadline := time.After(shutdownTimeout)
+	written := make(chan error, 1)
+	go func() {
+		written <- proc.write(request{JSONRPC: "2.0", Method: "shutdown"})
+	}()
+	select {
+	case <-written:
+	case <-deadline:
+	}
+	proc.stdin.Close()
+	select {
+	case <-proc.done:
+		return proc.err
+	case <-deadline:
+		proc.kill()
+		return nil
+	}
+}
+
+// killTimeout is how long a killed plugin is waited for.
+const killTimeout = 2 * time.Second
+
+// kill kills the process and its children. It waits for the process to exit
+// for at most killTimeout.
+func (proc *process) kill() {
+	proc.killOnce.Do(func() {
+		close(proc.killed)
+		proc.stdin.Close()
+		if err := killProcessGroup(proc.cmd.Process); err != nil {
+			proc.cmd.Process.Kill()
+		}
+	})
+	select {
+	case <-proc.done:
+	case <-time.After(killTimeout):
+	}
+}
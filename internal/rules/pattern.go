@@ -0,0 +1,72 @@
+package rules
+
+import (
+	"regexp"
+	"strings"
+)
+
+var placeholder = regexp.MustCompile(`:[A-Za-z_][A-Za-z0-9_]*`)
+var leadingPlaceholder = regexp.MustCompile(`^` + placeholder.String())
+
+// Pattern is a url path pattern. Placeholders such as :id match a single
+// path segment and * matches any number of them, as the "splat". Trailing
+// slashes are ignored.
+type Pattern struct {
+	re    *regexp.Regexp
+	names []string
+	splat bool
+}
+
+// NewPattern compiles a path pattern.
+func NewPattern(p string) Pattern {
+	pattern := Pattern{names: []string{}}
+	var re strings.Builder
+	re.WriteString("^")
+	p = trimSlash(p)
+	for i := 0; i < len(p); i++ {
+		switch {
+		case p[i] == '/' && p[i+1:] == "*":
+			// "/blog/*" also matches "/blog".
+			re.WriteString("(?:/(.*))?")
+			pattern.splat = true
+			i++
+		case p[i] == '*':
+			re.WriteString("(.*)")
+			pattern.splat = true
+		case p[i] == ':' && i > 0 && p[i-1] == '/' && leadingPlaceholder.MatchString(p[i:]):
+			m := leadingPlaceholder.FindString(p[i:])
+			pattern.names = append(pattern.names, m[1:])
+			re.WriteString("([^/]+)")
+			i += len(m) - 1
+		default:
+			re.WriteString(regexp.QuoteMeta(p[i : i+1]))
+		}
+	}
+	re.WriteString("/?$")
+	pattern.re = regexp.MustCompile(re.String())
+	return pattern
+}
+
+// Match reports whether the url path p matches the pattern, and returns the
+// values of its placeholders. The splat is named "splat".
+func (pattern Pattern) Match(p string) (map[string]string, bool) {
+	m := pattern.re.FindStringSubmatch(trimSlash(p))
+	if m == nil {
+		return nil, false
+	}
+	values := map[string]string{}
+	for i, name := range pattern.names {
+		values[name] = m[i+1]
+	}
+	if pattern.splat {
+		values["splat"] = m[len(m)-1]
+	}
+	return values, true
+}
+
+func trimSlash(p string) string {
+	if len(p) > 1 {
+		return strings.TrimSuffix(p, "/")
+	}
+	return p
+}
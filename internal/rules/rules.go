@@ -0,0 +1,260 @@
+// Package rules parses the _headers and _redirects files that static hosts
+// such as Netlify read from the root of a deployed site.
+package rules
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Error is a problem with a single line of a rules file. Hosts skip such
+// lines, so the rest of the file still applies.
+type Error struct {
+	File string
+	Line int
+	Text string
+}
+
+func (e Error) Error() string {
+	return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Text)
+}
+
+// Header is a block of a _headers file: the headers set on responses for
+// paths matching Path.
+type Header struct {
+	Line    int
+	Path    string
+	Headers http.Header
+
+	pattern Pattern
+}
+
+// Redirect is a line of a _redirects file. From may contain :placeholders,
+// which match a single path segment, and a trailing * splat. Query maps the
+// query parameters that must be present to the placeholders they bind.
+// To may refer to them, with :splat for the splat.
+type Redirect struct {
+	Line       int
+	From       string
+	Query      map[string]string
+	To         string
+	Status     int
+	Force      bool
+	Conditions map[string]string
+
+	pattern Pattern
+}
+
+// Proxy reports whether the rule rewrites to another origin.
+func (r Redirect) Proxy() bool {
+	return r.Status == http.StatusOK && IsExternal(r.To)
+}
+
+// IsExternal reports whether a rule target is an absolute url rather than a
+// path on the site.
+func IsExternal(to string) bool {
+	return strings.HasPrefix(to, "http://") || strings.HasPrefix(to, "https://")
+}
+
+// ParseHeaders parses a _headers file. Each block starts with a path on its
+// own line, followed by indented "Name: value" lines.
+func ParseHeaders(file string, data []byte) ([]Header, []Error) {
+	headers := []Header{}
+	errors := []Error{}
+	var current *Header
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		if trimmed == line {
+			if !strings.HasPrefix(trimmed, "/") {
+				errors = append(errors, Error{file, n, fmt.Sprintf("expected a path starting with \"/\", got %q", trimmed)})
+				current = nil
+				continue
+			}
+			headers = append(headers, Header{Line: n, Path: trimmed, Headers: http.Header{}, pattern: NewPattern(trimmed)})
+			current = &headers[len(headers)-1]
+			continue
+		}
+		if current == nil {
+			errors = append(errors, Error{file, n, "header is not preceded by a path"})
+			continue
+		}
+		i := strings.Index(trimmed, ":")
+		if i <= 0 {
+			errors = append(errors, Error{file, n, fmt.Sprintf("expected \"Name: value\", got %q", trimmed)})
+			continue
+		}
+		name := strings.TrimSpace(trimmed[:i])
+		if strings.ContainsAny(name, " \t") {
+			errors = append(errors, Error{file, n, fmt.Sprintf("invalid header name %q", name)})
+			continue
+		}
+		current.Headers.Add(name, strings.TrimSpace(trimmed[i+1:]))
+	}
+	return headers, errors
+}
+
+// ParseRedirects parses a _redirects file. Each line has the form
+//
+//	/from [param=:value ...] /to [status[!]] [Condition=value ...]
+//
+// The status defaults to 301. A trailing "!" forces the rule to apply even
+// when a file exists at the original path.
+func ParseRedirects(file string, data []byte) ([]Redirect, []Error) {
+	redirects := []Redirect{}
+	errors := []Error{}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		r, err := parseRedirect(fields)
+		if err != "" {
+			errors = append(errors, Error{file, n, err})
+			continue
+		}
+		r.Line = n
+		redirects = append(redirects, r)
+	}
+	return redirects, errors
+}
+
+func parseRedirect(fields []string) (Redirect, string) {
+	r := Redirect{Status: http.StatusMovedPermanently}
+	r.From = fields[0]
+	if !strings.HasPrefix(r.From, "/") && !IsExternal(r.From) {
+		return r, fmt.Sprintf("expected a path starting with \"/\", got %q", r.From)
+	}
+	if IsExternal(r.From) {
+		return r, "redirects from other domains are not supported"
+	}
+	if i := strings.Index(r.From, "*"); i >= 0 && i != len(r.From)-1 {
+		return r, "a splat (*) is only allowed at the end of a path"
+	}
+
+	fields = fields[1:]
+	for len(fields) > 0 && !strings.HasPrefix(fields[0], "/") && !IsExternal(fields[0]) {
+		i := strings.Index(fields[0], "=")
+		if i <= 0 {
+			return r, fmt.Sprintf("expected a query parameter or a target, got %q", fields[0])
+		}
+		if r.Query == nil {
+			r.Query = map[string]string{}
+		}
+		r.Query[fields[0][:i]] = fields[0][i+1:]
+		fields = fields[1:]
+	}
+	if len(fields) == 0 {
+		return r, "missing target"
+	}
+	r.To = fields[0]
+	fields = fields[1:]
+
+	if len(fields) > 0 && !strings.Contains(fields[0], "=") {
+		status := fields[0]
+		if strings.HasSuffix(status, "!") {
+			r.Force = true
+			status = strings.TrimSuffix(status, "!")
+		}
+		code, err := strconv.Atoi(status)
+		if err != nil || http.StatusText(code) == "" || code < 200 {
+			return r, fmt.Sprintf("invalid status code %q", fields[0])
+		}
+		r.Status = code
+		fields = fields[1:]
+	}
+	for _, f := range fields {
+		i := strings.Index(f, "=")
+		if i <= 0 {
+			return r, fmt.Sprintf("unexpected %q after the status code", f)
+		}
+		if r.Conditions == nil {
+			r.Conditions = map[string]string{}
+		}
+		r.Conditions[f[:i]] = f[i+1:]
+	}
+
+	if IsExternal(r.To) {
+		if _, err := url.Parse(r.To); err != nil {
+			return r, fmt.Sprintf("invalid target %q", r.To)
+		}
+	}
+	r.pattern = NewPattern(r.From)
+	bound := map[string]bool{"splat": strings.HasSuffix(r.From, "*")}
+	for _, name := range r.pattern.names {
+		bound[name] = true
+	}
+	for _, name := range r.Query {
+		bound[strings.TrimPrefix(name, ":")] = true
+	}
+	for _, m := range placeholder.FindAllString(r.To, -1) {
+		if !bound[m[1:]] {
+			return r, fmt.Sprintf("target uses %s, which is not bound by the rule", m)
+		}
+	}
+	return r, ""
+}
+
+// Match reports whether the header block applies to the url path p.
+func (h Header) Match(p string) bool {
+	_, ok := h.pattern.Match(p)
+	return ok
+}
+
+// Match reports whether the rule applies to a request for u, and if so
+// returns its target with placeholders filled in. Their values are escaped,
+// so that the target is a valid url even if they contain e.g. "%" or "?".
+func (r Redirect) Match(u *url.URL) (string, bool) {
+	values, ok := r.pattern.Match(u.Path)
+	if !ok {
+		return "", false
+	}
+	for name, v := range values {
+		values[name] = escapePath(v)
+	}
+	query := u.Query()
+	for param, name := range r.Query {
+		v, ok := query[param]
+		if !ok {
+			return "", false
+		}
+		if strings.HasPrefix(name, ":") {
+			values[name[1:]] = url.PathEscape(v[0])
+		} else if v[0] != name {
+			return "", false
+		}
+	}
+
+	to := placeholder.ReplaceAllStringFunc(r.To, func(m string) string {
+		if v, ok := values[m[1:]]; ok {
+			return v
+		}
+		return m
+	})
+	// Query parameters are passed through unless the rule matches on them.
+	if len(r.Query) == 0 && u.RawQuery != "" && !strings.Contains(to, "?") {
+		to += "?" + u.RawQuery
+	}
+	return to, true
+}
+
+// escapePath escapes every segment of the path p.
+func escapePath(p string) string {
+	segments := strings.Split(p, "/")
+	for i, s := range segments {
+		segments[i] = url.PathEscape(s)
+	}
+	return strings.Join(segments, "/")
+}
@@ -0,0 +1,185 @@
+package scaffold
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+	"unicode"
+)
+
+// GeneratorsDir holds the generators of a project, relative to its root.
+// Each subdirectory is a generator named after it, e.g. "component":
+//
+//	.pack/generators/component/src/components/{{pascal .name}}.tsx.tmpl
+//
+// Files are created at the same path relative to the project. Their names
+// are templates, rendered with the name given to the generator, and the
+// contents of files ending in ".tmpl" are too (the suffix is removed). Other
+// files are copied as-is. The functions pascal, camel, kebab and snake change
+// the case of a name.
+const GeneratorsDir = ".pack/generators"
+
+// Generators lists the generators of the project in dir.
+func Generators(dir string) ([]string, error) {
+	infos, err := ioutil.ReadDir(filepath.Join(dir, filepath.FromSlash(GeneratorsDir)))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	kinds := []string{}
+	for _, info := range infos {
+		if info.IsDir() {
+			kinds = append(kinds, info.Name())
+		}
+	}
+	return kinds, nil
+}
+
+var generatedName = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_-]*$`)
+
+// Generate creates the files of the generator kind in the project in dir,
+// and returns their paths relative to dir. Nothing is written if any of the
+// files already exists.
+func Generate(dir string, kind string, name string) ([]string, error) {
+	if !generatedName.MatchString(name) {
+		return nil, fmt.Errorf("invalid name %q, expected letters, digits, \"-\" and \"_\", starting with a letter", name)
+	}
+	kinds, err := Generators(dir)
+	if err != nil {
+		return nil, err
+	}
+	found := false
+	for _, k := range kinds {
+		found = found || k == kind
+	}
+	if !found {
+		if len(kinds) == 0 {
+			return nil, fmt.Errorf("the project has no generators, add them to %s/<kind>", GeneratorsDir)
+		}
+		return nil, fmt.Errorf("unknown generator %q, the project has: %s", kind, strings.Join(kinds, ", "))
+	}
+
+	root := filepath.Join(dir, filepath.FromSlash(GeneratorsDir), kind)
+	values := map[string]string{"name": name}
+	files := map[string][]byte{}
+	err = filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		rel, _ := filepath.Rel(root, p)
+		rel = filepath.ToSlash(rel)
+		target, err := generate(rel, rel, values)
+		if err != nil {
+			return err
+		}
+		data, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		if strings.HasSuffix(target, ".tmpl") {
+			target = strings.TrimSuffix(target, ".tmpl")
+			out, err := generate(rel, string(data), values)
+			if err != nil {
+				return err
+			}
+			data = []byte(out)
+		}
+		target = path.Clean(target)
+		if target == "." || target == ".." || strings.HasPrefix(target, "../") || path.IsAbs(target) {
+			return fmt.Errorf("%s: the file name renders outside of the project: %s", rel, target)
+		}
+		files[target] = data
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("generator %q: %w", kind, err)
+	}
+
+	created := []string{}
+	existing := []string{}
+	for target := range files {
+		created = append(created, target)
+		if _, err := os.Stat(filepath.Join(dir, filepath.FromSlash(target))); err == nil {
+			existing = append(existing, target)
+		}
+	}
+	sort.Strings(created)
+	sort.Strings(existing)
+	if len(existing) > 0 {
+		return nil, fmt.Errorf("refusing to overwrite existing files: %s", strings.Join(existing, ", "))
+	}
+	for _, target := range created {
+		p := filepath.Join(dir, filepath.FromSlash(target))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			return nil, err
+		}
+		if err := ioutil.WriteFile(p, files[target], 0644); err != nil {
+			return nil, err
+		}
+	}
+	return created, nil
+}
+
+var generatorFuncs = template.FuncMap{
+	"pascal": func(s string) string {
+		words := splitWords(s)
+		for i, w := range words {
+			words[i] = strings.ToUpper(w[:1]) + w[1:]
+		}
+		return strings.Join(words, "")
+	},
+	"camel": func(s string) string {
+		words := splitWords(s)
+		for i, w := range words {
+			if i > 0 {
+				words[i] = strings.ToUpper(w[:1]) + w[1:]
+			}
+		}
+		return strings.Join(words, "")
+	},
+	"kebab": func(s string) string { return strings.Join(splitWords(s), "-") },
+	"snake": func(s string) string { return strings.Join(splitWords(s), "_") },
+}
+
+// splitWords splits a name into lowercase words, at dashes, underscores and
+// case changes: "userProfile", "user-profile" and "UserProfile" are all
+// "user", "profile".
+func splitWords(s string) []string {
+	words := []string{}
+	word := []rune{}
+	runes := []rune(s)
+	for i, r := range runes {
+		boundary := r == '-' || r == '_' || r == ' '
+		upper := unicode.IsUpper(r) && i > 0 &&
+			(unicode.IsLower(runes[i-1]) || (i+1 < len(runes) && unicode.IsLower(runes[i+1])))
+		if (boundary || upper) && len(word) > 0 {
+			words = append(words, string(word))
+			word = word[:0]
+		}
+		if !boundary {
+			word = append(word, unicode.ToLower(r))
+		}
+	}
+	if len(word) > 0 {
+		words = append(words, string(word))
+	}
+	return words
+}
+
+func generate(name string, text string, values map[string]string) (string, error) {
+	t, err := template.New(name).Funcs(generatorFuncs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var out bytes.Buffer
+	if err := t.Execute(&out, values); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
@@ -0,0 +1,99 @@
+package scaffold
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// lockfiles maps the supported package managers to their lockfile.
+var lockfiles = map[string]string{
+	"npm":  "package-lock.json",
+	"yarn": "yarn.lock",
+	"pnpm": "pnpm-lock.yaml",
+}
+
+// PackageManagers lists the supported package managers.
+var PackageManagers = []string{"npm", "yarn", "pnpm"}
+
+// ValidPackageManager reports whether name is a supported package manager.
+func ValidPackageManager(name string) bool {
+	_, ok := lockfiles[name]
+	return ok
+}
+
+// DetectPackageManager returns the package manager the project in dir was
+// locked with, or npm if it has no lockfile.
+func DetectPackageManager(dir string) string {
+	for _, name := range PackageManagers {
+		if _, err := os.Stat(filepath.Join(dir, lockfiles[name])); err == nil {
+			return name
+		}
+	}
+	return "npm"
+}
+
+// Install installs the dependencies of the project in dir with manager.
+// Lockfiles of other package managers are removed, since they would get out
+// of date. Projects without a package.json have nothing to install.
+func Install(ctx context.Context, dir string, manager string) error {
+	if _, err := os.Stat(filepath.Join(dir, "package.json")); err != nil {
+		return nil
+	}
+	if _, err := exec.LookPath(manager); err != nil {
+		return fmt.Errorf("%s isn't installed. Install it, pick another package manager with --package-manager, or skip this step with --no-install", manager)
+	}
+	for name, lockfile := range lockfiles {
+		if name != manager {
+			if err := os.Remove(filepath.Join(dir, lockfile)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	fmt.Printf("> Installing node_modules with %s\n", manager)
+	return run(ctx, dir, manager, "install")
+}
+
+// GitInit creates a git repository in dir, with the project as its first
+// commit. The commit is skipped if git can't make it, e.g. because no
+// identity is configured.
+func GitInit(ctx context.Context, dir string) error {
+	if _, err := exec.LookPath("git"); err != nil {
+		return fmt.Errorf("git isn't installed")
+	}
+	fmt.Printf("> Initializing a git repository\n")
+	if err := run(ctx, dir, "git", "init", "--quiet"); err != nil {
+		return err
+	}
+	if err := run(ctx, dir, "git", "add", "--all"); err != nil {
+		return err
+	}
+	if err := run(ctx, dir, "git", "commit", "--quiet", "--message", "Initial commit"); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		fmt.Printf("warning: skipped the initial commit: %s\n", err)
+	}
+	return nil
+}
+
+// run runs a command in dir. Its output is part of the error if it fails.
+func run(ctx context.Context, dir string, name string, args ...string) error {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		msg := strings.TrimSpace(string(out))
+		if msg == "" {
+			return fmt.Errorf("%s %s: %w", name, strings.Join(args, " "), err)
+		}
+		return fmt.Errorf("%s %s: %w\n%s", name, strings.Join(args, " "), err, msg)
+	}
+	return nil
+}
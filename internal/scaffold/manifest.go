@@ -0,0 +1,287 @@
+package scaffold
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// ManifestFile is the name of the manifest a template can have at its root.
+// It's removed from the created project.
+const ManifestFile = "pack-template.json"
+
+// Manifest declares the variables of a template:
+//
+//	{
+//	  "variables": [
+//	    {"name": "name", "prompt": "Package name", "default": "{{slug .dir}}", "pattern": "^[a-z0-9-]+$"},
+//	    {"name": "title", "prompt": "Page title", "default": "{{.name}}"}
+//	  ],
+//	  "files": ["package.json", "src/*.html"],
+//	  "postCreate": [["npm", "run", "setup"]]
+//	}
+//
+// Variables are substituted with text/template, e.g. {{.name}}, into the
+// files matching one of the "files" patterns, and into every file name. Other
+// files are copied as-is, since source code often contains "{{" already.
+// Besides the functions of text/template, such as html and js for escaping,
+// templates can use slug, which turns e.g. "My App" into "my-app".
+type Manifest struct {
+	Variables []Variable `json:"variables"`
+	// Files are path.Match patterns, relative to the template.
+	Files []string `json:"files"`
+	// PostCreate are commands to run in the project once it's created and its
+	// dependencies are installed. Their arguments are templates too.
+	PostCreate [][]string `json:"postCreate"`
+}
+
+// Variable is a value asked for when creating a project.
+type Variable struct {
+	Name   string `json:"name"`
+	Prompt string `json:"prompt"`
+	// Default is a template, rendered with the variables declared before it.
+	// Variables without a default must be given a value.
+	Default string `json:"default"`
+	// Pattern is a regular expression that values must match, if any.
+	Pattern string `json:"pattern"`
+}
+
+// ReadManifest reads the manifest of the template in dir. Templates without
+// one have no variables.
+func ReadManifest(dir string) (Manifest, error) {
+	m := Manifest{}
+	data, err := ioutil.ReadFile(filepath.Join(dir, ManifestFile))
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return m, err
+	}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return m, fmt.Errorf("%s: %w", ManifestFile, err)
+	}
+	for _, v := range m.Variables {
+		if v.Name == "" || v.Name == "dir" {
+			return m, fmt.Errorf("%s: invalid variable name %q", ManifestFile, v.Name)
+		}
+		if _, err := regexp.Compile(v.Pattern); err != nil {
+			return m, fmt.Errorf("%s: invalid pattern of %q: %w", ManifestFile, v.Name, err)
+		}
+	}
+	for _, pattern := range m.Files {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return m, fmt.Errorf("%s: invalid file pattern %q", ManifestFile, pattern)
+		}
+	}
+	return m, nil
+}
+
+// Values resolves the variables of the manifest for a project created in
+// dir, which is also available as the "dir" variable. Variables without a
+// value in given are asked for with prompt, if any, and fall back to their
+// default otherwise.
+func (m Manifest) Values(dir string, given map[string]string, prompt func(Variable, string) (string, error)) (map[string]string, error) {
+	values := map[string]string{"dir": filepath.Base(dir)}
+	for name := range given {
+		if !m.declares(name) {
+			return nil, fmt.Errorf("unknown template variable %q%s", name, m.declared())
+		}
+	}
+	for _, v := range m.Variables {
+		value, ok := given[v.Name]
+		if !ok {
+			def, err := render(v.Name, v.Default, values)
+			if err != nil {
+				return nil, fmt.Errorf("%s: the default of %q: %w", ManifestFile, v.Name, err)
+			}
+			value = def
+			if prompt != nil {
+				if value, err = prompt(v, def); err != nil {
+					return nil, err
+				}
+			}
+			if value == "" {
+				return nil, fmt.Errorf("missing a value for the template variable %q, pass it with --var=%s=<value>", v.Name, v.Name)
+			}
+		}
+		if v.Pattern != "" && !regexp.MustCompile(v.Pattern).MatchString(value) {
+			return nil, fmt.Errorf("invalid value %q for the template variable %q, it must match %s", value, v.Name, v.Pattern)
+		}
+		values[v.Name] = value
+	}
+	return values, nil
+}
+
+func (m Manifest) declares(name string) bool {
+	for _, v := range m.Variables {
+		if v.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (m Manifest) declared() string {
+	if len(m.Variables) == 0 {
+		return ", the template has no variables"
+	}
+	names := []string{}
+	for _, v := range m.Variables {
+		names = append(names, v.Name)
+	}
+	return ", the template has: " + strings.Join(names, ", ")
+}
+
+// Render substitutes values into the project created in dir, and removes
+// the manifest.
+func (m Manifest) Render(dir string, values map[string]string) error {
+	if err := os.Remove(filepath.Join(dir, ManifestFile)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	files := []string{}
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			files = append(files, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Strings(files)
+
+	for _, file := range files {
+		rel, _ := filepath.Rel(dir, file)
+		rel = filepath.ToSlash(rel)
+		// Generators are templates of their own.
+		if strings.HasPrefix(rel, GeneratorsDir+"/") {
+			continue
+		}
+		if m.renders(rel) {
+			data, err := ioutil.ReadFile(file)
+			if err != nil {
+				return err
+			}
+			out, err := render(rel, string(data), values)
+			if err != nil {
+				return err
+			}
+			if err := ioutil.WriteFile(file, []byte(out), 0644); err != nil {
+				return err
+			}
+		}
+		if !strings.Contains(rel, "{{") {
+			continue
+		}
+		// Files whose name renders empty are left out, which allows
+		// optional files.
+		name, err := render(rel, rel, values)
+		if err != nil {
+			return err
+		}
+		if name == "" || strings.HasSuffix(name, "/") || strings.Contains(name, "//") {
+			if err := os.Remove(file); err != nil {
+				return err
+			}
+			continue
+		}
+		target := filepath.Join(dir, filepath.FromSlash(path.Clean(name)))
+		if !strings.HasPrefix(target, filepath.Clean(dir)+string(filepath.Separator)) {
+			return fmt.Errorf("%s: the file name renders outside of the project: %s", rel, name)
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		if err := os.Rename(file, target); err != nil {
+			return err
+		}
+	}
+	return removeEmptyDirs(dir)
+}
+
+func (m Manifest) renders(rel string) bool {
+	for _, pattern := range m.Files {
+		if ok, _ := path.Match(pattern, rel); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// removeEmptyDirs removes the directories left empty by renamed files.
+func removeEmptyDirs(dir string) error {
+	dirs := []string{}
+	filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err == nil && info.IsDir() && p != dir && strings.Contains(p, "{{") {
+			dirs = append(dirs, p)
+		}
+		return nil
+	})
+	// Deepest first.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if infos, err := ioutil.ReadDir(dirs[i]); err == nil && len(infos) == 0 {
+			if err := os.Remove(dirs[i]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// RunPostCreate runs the post-create commands of the manifest in dir.
+func (m Manifest) RunPostCreate(ctx context.Context, dir string, values map[string]string) error {
+	for _, step := range m.PostCreate {
+		if len(step) == 0 {
+			continue
+		}
+		args := make([]string, len(step))
+		for i, arg := range step {
+			var err error
+			if args[i], err = render(ManifestFile, arg, values); err != nil {
+				return err
+			}
+		}
+		fmt.Printf("> Running %s\n", strings.Join(args, " "))
+		cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+		cmd.Dir = dir
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("the post-create step %q failed: %w", strings.Join(args, " "), err)
+		}
+	}
+	return nil
+}
+
+func render(name string, text string, values map[string]string) (string, error) {
+	t, err := template.New(name).Option("missingkey=error").Funcs(template.FuncMap{"slug": slug}).Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var out bytes.Buffer
+	if err := t.Execute(&out, values); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+var notSlug = regexp.MustCompile(`[^a-z0-9]+`)
+
+// slug lowercases s and joins its words with dashes, which makes it a valid
+// npm package name, among others.
+func slug(s string) string {
+	return strings.Trim(notSlug.ReplaceAllString(strings.ToLower(s), "-"), "-")
+}
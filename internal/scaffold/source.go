@@ -0,0 +1,363 @@
+// Package scaffold creates new projects from templates.
+package scaffold
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/davezuko/pack/templates"
+)
+
+// Source is where a template comes from, parsed from the --template syntax:
+//
+//	typescript-react                        a built-in template
+//	./starter, ~/starter                    a local directory
+//	starter.tar.gz, starter.zip             a local archive (.tar.gz, .tgz or .zip)
+//	https://example.com/starter.zip         a remote archive
+//	user/repo                               a GitHub repository
+//	https://git.example.com/team/repo.git   any git repository
+//
+// Git repositories accept a "#ref:subdir" suffix, e.g. "user/repo#v2",
+// "user/repo#main:templates/app" or "user/repo#:templates/app".
+type Source struct {
+	Kind   string // "builtin", "dir", "archive", "git"
+	Path   string // template name, file path, or url
+	Ref    string
+	Subdir string
+}
+
+var githubShorthand = regexp.MustCompile(`^[\w.-]+/[\w.-]+$`)
+
+// ParseSource parses a template source, and checks that local ones exist.
+func ParseSource(src string) (Source, error) {
+	if src == "" {
+		return Source{}, fmt.Errorf("missing template")
+	}
+	if templates.Exists(src) {
+		return Source{Kind: "builtin", Path: src}, nil
+	}
+	src, err := expandHome(src)
+	if err != nil {
+		return Source{}, err
+	}
+	if isArchive(src) {
+		if isURL(src) {
+			return Source{Kind: "archive", Path: src}, nil
+		}
+		info, err := os.Stat(src)
+		if err != nil || info.IsDir() {
+			return Source{}, fmt.Errorf("template archive %q does not exist", src)
+		}
+		return Source{Kind: "archive", Path: src}, nil
+	}
+	if info, err := os.Stat(src); err == nil {
+		if !info.IsDir() {
+			return Source{}, fmt.Errorf("template %q is a file, expected a directory or a .tar.gz, .tgz or .zip archive", src)
+		}
+		return Source{Kind: "dir", Path: src}, nil
+	}
+	if isLocalPath(src) {
+		return Source{}, fmt.Errorf("template directory %q does not exist", src)
+	}
+
+	source := Source{Kind: "git", Path: src}
+	if i := strings.LastIndex(src, "#"); i >= 0 {
+		source.Path = src[:i]
+		fragment := src[i+1:]
+		if j := strings.Index(fragment, ":"); j >= 0 {
+			source.Ref, source.Subdir = fragment[:j], fragment[j+1:]
+		} else {
+			source.Ref = fragment
+		}
+		if strings.Contains(source.Subdir, "..") || filepath.IsAbs(source.Subdir) {
+			return Source{}, fmt.Errorf("invalid template subdirectory %q", source.Subdir)
+		}
+		// git would read it as an option.
+		if strings.HasPrefix(source.Ref, "-") {
+			return Source{}, fmt.Errorf("invalid template ref %q", source.Ref)
+		}
+	}
+	switch {
+	case githubShorthand.MatchString(source.Path):
+		source.Path = "https://github.com/" + source.Path
+	case isURL(source.Path), strings.HasPrefix(source.Path, "git@"), strings.HasPrefix(source.Path, "ssh://"),
+		strings.HasPrefix(source.Path, "git://"), strings.HasPrefix(source.Path, "file://"):
+	default:
+		names := []string{}
+		for _, t := range templates.Builtin {
+			names = append(names, t.Name)
+		}
+		return Source{}, fmt.Errorf("unknown template %q. Use a built-in template (%s), a directory, a .tar.gz or .zip archive, or a git repository", src, strings.Join(names, ", "))
+	}
+	return source, nil
+}
+
+func (s Source) String() string {
+	str := s.Path
+	if s.Ref != "" || s.Subdir != "" {
+		str += "#" + s.Ref
+		if s.Subdir != "" {
+			str += ":" + s.Subdir
+		}
+	}
+	return str
+}
+
+func isURL(s string) bool {
+	return strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://")
+}
+
+// expandHome replaces the "~" that a path starts with by the user's home
+// directory, as a shell would.
+func expandHome(s string) (string, error) {
+	if s != "~" && !strings.HasPrefix(s, "~/") && !strings.HasPrefix(s, "~"+string(filepath.Separator)) {
+		return s, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to expand %q: %w", s, err)
+	}
+	return filepath.Join(home, s[1:]), nil
+}
+
+func isLocalPath(s string) bool {
+	return filepath.IsAbs(s) || strings.HasPrefix(s, ".") || strings.HasPrefix(s, "~")
+}
+
+func isArchive(s string) bool {
+	s = strings.ToLower(s)
+	return strings.HasSuffix(s, ".tar.gz") || strings.HasSuffix(s, ".tgz") || strings.HasSuffix(s, ".zip")
+}
+
+// Fetch writes the files of the template to dir, which must not exist.
+func Fetch(source Source, dir string) error {
+	switch source.Kind {
+	case "builtin":
+		return templates.Copy(source.Path, dir)
+	case "dir":
+		return copyDir(source.Path, dir)
+	case "archive":
+		return fetchArchive(source.Path, dir)
+	case "git":
+		return fetchGit(source, dir)
+	}
+	return fmt.Errorf("unknown template source %q", source.Kind)
+}
+
+// ignored are the files that are never copied from a template.
+var ignored = map[string]bool{".git": true, "node_modules": true}
+
+func copyDir(src string, dst string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if ignored[info.Name()] && path != src {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, _ := filepath.Rel(src, path)
+		target := filepath.Join(dst, rel)
+		switch {
+		case info.IsDir():
+			return os.MkdirAll(target, 0755)
+		case info.Mode().IsRegular():
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			return ioutil.WriteFile(target, data, info.Mode().Perm())
+		}
+		return nil
+	})
+}
+
+func fetchArchive(src string, dir string) error {
+	var data []byte
+	var err error
+	if isURL(src) {
+		data, err = download(src)
+	} else {
+		data, err = ioutil.ReadFile(src)
+	}
+	if err != nil {
+		return err
+	}
+
+	files := map[string][]byte{}
+	if strings.HasSuffix(strings.ToLower(src), ".zip") {
+		err = readZip(data, files)
+	} else {
+		err = readTarGz(data, files)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read the template archive %s: %w", src, err)
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("the template archive %s is empty", src)
+	}
+
+	// Archives of a single directory, such as the ones GitHub generates, are
+	// extracted without it.
+	root := ""
+	for name := range files {
+		top := strings.SplitN(name, "/", 2)[0]
+		if root == "" {
+			root = top
+		}
+		if top != root || !strings.Contains(name, "/") {
+			root = ""
+			break
+		}
+	}
+	for name, contents := range files {
+		name = strings.TrimPrefix(name, root+"/")
+		if ignored[strings.SplitN(name, "/", 2)[0]] {
+			continue
+		}
+		target := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(target, contents, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func download(url string) ([]byte, error) {
+	client := http.Client{Timeout: 2 * time.Minute}
+	res, err := client.Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download the template: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to download the template from %s: %s", url, res.Status)
+	}
+	return ioutil.ReadAll(res.Body)
+}
+
+// archivePath validates the name of an archive entry. Entries that would be
+// written outside of the project are rejected.
+func archivePath(name string) (string, error) {
+	name = strings.TrimPrefix(filepath.ToSlash(name), "./")
+	if strings.HasPrefix(name, "/") || name == ".." || strings.HasPrefix(name, "../") || strings.Contains(name, "/../") {
+		return "", fmt.Errorf("invalid file name %q", name)
+	}
+	return name, nil
+}
+
+func readTarGz(data []byte, files map[string][]byte) error {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	r := tar.NewReader(gz)
+	for {
+		h, err := r.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if h.Typeflag != tar.TypeReg {
+			continue
+		}
+		name, err := archivePath(h.Name)
+		if err != nil {
+			return err
+		}
+		if files[name], err = ioutil.ReadAll(r); err != nil {
+			return err
+		}
+	}
+}
+
+func readZip(data []byte, files map[string][]byte) error {
+	r, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return err
+	}
+	for _, f := range r.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		name, err := archivePath(f.Name)
+		if err != nil {
+			return err
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		files[name], err = ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func fetchGit(source Source, dir string) error {
+	if _, err := exec.LookPath("git"); err != nil {
+		return fmt.Errorf("git is required to use the template %s, but it wasn't found", source)
+	}
+	tmp, err := ioutil.TempDir("", "pack-new")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	args := []string{"clone", "--depth", "1"}
+	if source.Ref != "" {
+		args = append(args, "--branch", source.Ref)
+	}
+	if out, err := exec.Command("git", append(args, source.Path, tmp)...).CombinedOutput(); err != nil {
+		if source.Ref == "" {
+			return gitError(source, out, err)
+		}
+		// Shallow clones only work with branches and tags, commits need the
+		// whole history.
+		os.RemoveAll(tmp)
+		if out, err := exec.Command("git", "clone", source.Path, tmp).CombinedOutput(); err != nil {
+			return gitError(source, out, err)
+		}
+		cmd := exec.Command("git", "checkout", source.Ref, "--")
+		cmd.Dir = tmp
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return gitError(source, out, err)
+		}
+	}
+
+	src := filepath.Join(tmp, filepath.FromSlash(source.Subdir))
+	if info, err := os.Stat(src); err != nil || !info.IsDir() {
+		return fmt.Errorf("the directory %q does not exist in %s", source.Subdir, source.Path)
+	}
+	return copyDir(src, dir)
+}
+
+func gitError(source Source, out []byte, err error) error {
+	msg := strings.TrimSpace(string(out))
+	if msg == "" {
+		msg = err.Error()
+	}
+	return fmt.Errorf("failed to clone the template %s with git:\n%s", source, msg)
+}
@@ -0,0 +1,207 @@
+package testrunner
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// Reporters lists the supported report formats.
+var Reporters = []string{"pretty", "tap", "junit"}
+
+// ValidReporter reports whether format is a supported report format. Empty
+// is the default, "pretty".
+func ValidReporter(format string) bool {
+	for _, r := range Reporters {
+		if r == format {
+			return true
+		}
+	}
+	return format == ""
+}
+
+// Report writes the result in the given format: "pretty", "tap" or "junit".
+func Report(w io.Writer, format string, result Result) error {
+	switch format {
+	case "", "pretty":
+		return reportPretty(w, result)
+	case "tap":
+		return reportTAP(w, result)
+	case "junit":
+		return reportJUnit(w, result)
+	}
+	return fmt.Errorf("unknown reporter %q, expected one of: %s", format, strings.Join(Reporters, ", "))
+}
+
+// reportPretty writes a human readable report. Like `go test`, the output
+// of a file is only shown when it has failures.
+func reportPretty(w io.Writer, result Result) error {
+	for _, f := range result.Files {
+		if len(f.Tests) == 0 && !f.Failed() {
+			continue
+		}
+		fmt.Fprintf(w, "%s (%s)\n", f.File, formatDuration(f.Duration))
+		for _, t := range f.Tests {
+			fmt.Fprintf(w, "  [%s] %s\n", t.Status, t.Name)
+			if t.Status == "fail" {
+				for _, log := range t.Logs {
+					fmt.Fprintf(w, "%s\n", indent(log, "    "))
+				}
+			}
+		}
+		if f.Failed() && strings.TrimSpace(f.Output) != "" {
+			fmt.Fprintf(w, "  output:\n%s\n", indent(strings.TrimRight(f.Output, "\n"), "    "))
+		}
+		if f.Err != "" {
+			fmt.Fprintf(w, "  [error] %s\n", f.Err)
+		}
+	}
+	passed, failed, skipped := result.Counts()
+	_, err := fmt.Fprintf(w, "\n%d passed, %d failed, %d skipped in %s\n", passed, failed, skipped, formatDuration(result.Duration))
+	return err
+}
+
+// reportTAP writes a report in the Test Anything Protocol, version 13.
+func reportTAP(w io.Writer, result Result) error {
+	lines := []string{}
+	n := 0
+	for _, f := range result.Files {
+		for _, t := range f.Tests {
+			n++
+			name := strings.ReplaceAll(f.File+" > "+t.Name, "#", "\\#")
+			switch t.Status {
+			case "pass":
+				lines = append(lines, fmt.Sprintf("ok %d - %s", n, name))
+			case "skip":
+				lines = append(lines, fmt.Sprintf("ok %d - %s # SKIP", n, name))
+			default:
+				lines = append(lines, fmt.Sprintf("not ok %d - %s", n, name))
+				lines = append(lines, tapDiagnostics(t.Logs, t.Duration)...)
+			}
+		}
+		if f.Err != "" {
+			n++
+			lines = append(lines, fmt.Sprintf("not ok %d - %s", n, f.File))
+			lines = append(lines, tapDiagnostics([]string{f.Err, f.Output}, f.Duration)...)
+		}
+	}
+	out := "TAP version 13\n" + fmt.Sprintf("1..%d\n", n)
+	for _, line := range lines {
+		out += line + "\n"
+	}
+	_, err := io.WriteString(w, out)
+	return err
+}
+
+// tapDiagnostics formats messages as a YAML block, which TAP consumers show
+// with the failure.
+func tapDiagnostics(messages []string, d time.Duration) []string {
+	lines := []string{"  ---", fmt.Sprintf("  duration_ms: %.3f", float64(d.Microseconds())/1000)}
+	message := strings.TrimSpace(strings.Join(messages, "\n"))
+	if message != "" {
+		lines = append(lines, "  message: |")
+		for _, line := range strings.Split(message, "\n") {
+			lines = append(lines, "    "+line)
+		}
+	}
+	return append(lines, "  ...")
+}
+
+type junitSuites struct {
+	XMLName  xml.Name     `xml:"testsuites"`
+	Tests    int          `xml:"tests,attr"`
+	Failures int          `xml:"failures,attr"`
+	Skipped  int          `xml:"skipped,attr"`
+	Time     string       `xml:"time,attr"`
+	Suites   []junitSuite `xml:"testsuite"`
+}
+
+type junitSuite struct {
+	Name      string      `xml:"name,attr"`
+	Tests     int         `xml:"tests,attr"`
+	Failures  int         `xml:"failures,attr"`
+	Errors    int         `xml:"errors,attr"`
+	Skipped   int         `xml:"skipped,attr"`
+	Time      string      `xml:"time,attr"`
+	Cases     []junitCase `xml:"testcase"`
+	Error     *junitError `xml:"error,omitempty"`
+	SystemOut string      `xml:"system-out,omitempty"`
+}
+
+type junitCase struct {
+	Name      string      `xml:"name,attr"`
+	Classname string      `xml:"classname,attr"`
+	Time      string      `xml:"time,attr"`
+	Failure   *junitError `xml:"failure,omitempty"`
+	Skipped   *struct{}   `xml:"skipped,omitempty"`
+}
+
+type junitError struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// reportJUnit writes a report in the JUnit XML format understood by most CI
+// servers. Each test file is a test suite.
+func reportJUnit(w io.Writer, result Result) error {
+	passed, failed, skipped := result.Counts()
+	report := junitSuites{
+		Tests:    passed + failed + skipped,
+		Failures: failed,
+		Skipped:  skipped,
+		Time:     junitTime(result.Duration),
+	}
+	for _, f := range result.Files {
+		suite := junitSuite{Name: f.File, Time: junitTime(f.Duration), Tests: len(f.Tests)}
+		for _, t := range f.Tests {
+			c := junitCase{Name: t.Name, Classname: f.File, Time: junitTime(t.Duration)}
+			switch t.Status {
+			case "fail":
+				suite.Failures++
+				message := "failed"
+				if len(t.Logs) > 0 {
+					message = strings.SplitN(t.Logs[0], "\n", 2)[0]
+				}
+				c.Failure = &junitError{Message: message, Text: strings.Join(t.Logs, "\n")}
+			case "skip":
+				suite.Skipped++
+				c.Skipped = &struct{}{}
+			}
+			suite.Cases = append(suite.Cases, c)
+		}
+		if f.Err != "" {
+			suite.Errors = 1
+			suite.Error = &junitError{Message: f.Err, Text: f.Output}
+		} else if f.Failed() {
+			suite.SystemOut = f.Output
+		}
+		report.Suites = append(report.Suites, suite)
+	}
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(report); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+func junitTime(d time.Duration) string {
+	return fmt.Sprintf("%.3f", d.Seconds())
+}
+
+func formatDuration(d time.Duration) string {
+	if d < time.Second {
+		return fmt.Sprintf("%dms", d.Milliseconds())
+	}
+	return fmt.Sprintf("%.2fs", d.Seconds())
+}
+
+func indent(s string, prefix string) string {
+	return prefix + strings.ReplaceAll(s, "\n", "\n"+prefix)
+}
@@ -0,0 +1,361 @@
+// Package testrunner runs the tests of a project in node. Tests are written
+// with the testing library of the @davezuko/pack npm package, which reports
+// results back to the runner as lines of JSON in a separate file (see
+// npm/src/testing/test_protocol.ts).
+package testrunner
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	esbuild "github.com/evanw/esbuild/pkg/api"
+
+	"github.com/davezuko/pack/internal/bundler"
+	"github.com/davezuko/pack/internal/coverage"
+)
+
+// Options configures a test run.
+type Options struct {
+	// Root is the directory test files are discovered in.
+	Root string
+	// Run is a regular expression (in JavaScript syntax) that the names of
+	// the tests to run must match.
+	Run string
+	// Coverage collects the code coverage of the sources in Root.
+	Coverage bool
+}
+
+// Result holds the results of a test run.
+type Result struct {
+	Files []FileResult
+	// Errors are failures to run the tests at all, e.g. bundling errors.
+	Errors   []string
+	Duration time.Duration
+	// Coverage is set if Options.Coverage was.
+	Coverage *coverage.Coverage
+}
+
+// FileResult holds the results of the tests of a file.
+type FileResult struct {
+	File  string
+	Tests []TestResult
+	// Output is what the tests printed to stdout and stderr.
+	Output string
+	// Err is set if the file couldn't run to completion, e.g. because it
+	// threw outside of a test.
+	Err      string
+	Duration time.Duration
+}
+
+// TestResult is the result of a single test.
+type TestResult struct {
+	Name string
+	// Status is "pass", "fail" or "skip".
+	Status   string
+	Logs     []string
+	Duration time.Duration
+}
+
+// Failed reports whether the file has failures.
+func (f FileResult) Failed() bool {
+	if f.Err != "" {
+		return true
+	}
+	for _, t := range f.Tests {
+		if t.Status == "fail" {
+			return true
+		}
+	}
+	return false
+}
+
+// Counts returns the number of passed, failed and skipped tests. Files that
+// couldn't run count as a failure.
+func (r Result) Counts() (passed int, failed int, skipped int) {
+	for _, f := range r.Files {
+		if f.Err != "" {
+			failed++
+		}
+		for _, t := range f.Tests {
+			switch t.Status {
+			case "pass":
+				passed++
+			case "fail":
+				failed++
+			case "skip":
+				skipped++
+			}
+		}
+	}
+	return passed, failed, skipped
+}
+
+// IsTestFile reports whether path is a test file: *_test.ts(x) or
+// *.test.ts(x).
+func IsTestFile(path string) bool {
+	name := filepath.Base(path)
+	for _, ext := range []string{".ts", ".tsx"} {
+		if strings.HasSuffix(name, "_test"+ext) || strings.HasSuffix(name, ".test"+ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// Discover returns the test files in root.
+func Discover(root string) ([]string, error) {
+	files := []string{}
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && info.Name() == "node_modules" {
+			return filepath.SkipDir
+		}
+		if info.Mode().IsRegular() && IsTestFile(path) {
+			files = append(files, path)
+		}
+		return nil
+	})
+	sort.Strings(files)
+	return files, err
+}
+
+// Run bundles the test files of the project and runs each of them in its
+// own node process.
+func Run(ctx context.Context, opts Options) Result {
+	start := time.Now()
+	result := Result{Files: []FileResult{}, Errors: []string{}}
+	done := func() Result {
+		result.Duration = time.Since(start)
+		return result
+	}
+
+	files, err := Discover(opts.Root)
+	if err != nil {
+		result.Errors = append(result.Errors, err.Error())
+		return done()
+	}
+	if len(files) == 0 {
+		return done()
+	}
+	node, err := exec.LookPath("node")
+	if err != nil {
+		result.Errors = append(result.Errors, "node is required to run tests, but it wasn't found")
+		return done()
+	}
+
+	b := bundler.New(bundler.NewOptions{Mode: "test", Root: opts.Root})
+	bundle := b.Bundle(files)
+	for _, msg := range bundle.Errors {
+		result.Errors = append(result.Errors, formatMessage(msg))
+	}
+	if len(result.Errors) > 0 {
+		return done()
+	}
+
+	tmp, err := ioutil.TempDir("", "pack-test")
+	if err != nil {
+		result.Errors = append(result.Errors, err.Error())
+		return done()
+	}
+	defer os.RemoveAll(tmp)
+	// Coverage is reported by script path, which has symlinks resolved.
+	if tmp, err = filepath.EvalSymlinks(tmp); err != nil {
+		result.Errors = append(result.Errors, err.Error())
+		return done()
+	}
+	v8Dir := ""
+	if opts.Coverage {
+		v8Dir = filepath.Join(tmp, "__coverage")
+	}
+	scripts := map[string]coverage.Script{}
+	for _, f := range bundle.OutputFiles {
+		p := filepath.Join(tmp, filepath.FromSlash(f.Path))
+		if strings.HasSuffix(f.Path, ".map") {
+			f.Contents = absoluteSourceMap(f.Path, f.Contents)
+			script := strings.TrimSuffix(p, ".map")
+			scripts[script] = coverage.Script{Code: scripts[script].Code, SourceMap: f.Contents}
+		} else if strings.HasSuffix(f.Path, ".js") {
+			scripts[p] = coverage.Script{Code: f.Contents, SourceMap: scripts[p].SourceMap}
+		}
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err == nil {
+			err = ioutil.WriteFile(p, f.Contents, 0644)
+		}
+		if err != nil {
+			result.Errors = append(result.Errors, err.Error())
+			return done()
+		}
+	}
+
+	result.Files = make([]FileResult, len(files))
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, runtime.NumCPU())
+	for i, file := range files {
+		rel, _ := filepath.Rel(opts.Root, file)
+		script := filepath.Join(tmp, strings.TrimSuffix(rel, filepath.Ext(rel))+".js")
+		wg.Add(1)
+		go func(i int, file string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			result.Files[i] = runFile(ctx, node, file, script, v8Dir, opts)
+		}(i, file)
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		result.Errors = append(result.Errors, "the test run was interrupted")
+		return done()
+	}
+
+	if opts.Coverage {
+		root, _ := filepath.Abs(opts.Root)
+		c, err := coverage.FromV8(v8Dir, scripts, func(source string) bool {
+			return coverage.IsSource(root, source, IsTestFile)
+		})
+		if err == nil {
+			err = c.AddSources(sources(root))
+		}
+		if err != nil {
+			result.Errors = append(result.Errors, fmt.Sprintf("failed to read the coverage: %s", err))
+		} else {
+			result.Coverage = &c
+		}
+	}
+	return done()
+}
+
+// sources returns the files of root that coverage is reported for.
+func sources(root string) []string {
+	files := []string{}
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info.IsDir() && info.Name() == "node_modules" {
+			return filepath.SkipDir
+		}
+		if info.Mode().IsRegular() && coverage.IsScript(path) && !IsTestFile(path) {
+			files = append(files, path)
+		}
+		return nil
+	})
+	return files
+}
+
+type protocolEvent struct {
+	Type       string   `json:"type"`
+	Name       string   `json:"name"`
+	Stat       string   `json:"stat"`
+	Logs       []string `json:"logs"`
+	DurationMs float64  `json:"durationMs"`
+}
+
+func runFile(ctx context.Context, node string, file string, script string, v8Dir string, opts Options) FileResult {
+	start := time.Now()
+	result := FileResult{File: file, Tests: []TestResult{}}
+
+	// Results are written to a file rather than to an inherited pipe, which
+	// Windows can't pass to node.
+	results := script + ".results"
+	var output bytes.Buffer
+	cmd := exec.CommandContext(ctx, node, "--enable-source-maps", script, "--global")
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	cmd.Env = append(os.Environ(),
+		"NODE_ENV=test",
+		"PACK_TEST_PROTOCOL="+results,
+		"PACK_TEST_RUN="+opts.Run,
+	)
+	if v8Dir != "" {
+		cmd.Env = append(cmd.Env, "NODE_V8_COVERAGE="+v8Dir)
+	}
+	if err := cmd.Start(); err != nil {
+		result.Err = err.Error()
+		return result
+	}
+	if err := cmd.Wait(); err != nil {
+		result.Err = fmt.Sprintf("node exited with an error: %s", err)
+	}
+	tests, err := readResults(results)
+	if err != nil && result.Err == "" {
+		result.Err = err.Error()
+	}
+	result.Tests = append(result.Tests, tests...)
+	result.Output = output.String()
+	result.Duration = time.Since(start)
+	return result
+}
+
+// readResults reads the results a test file wrote to path. A file that
+// didn't run any test doesn't create it.
+func readResults(path string) ([]TestResult, error) {
+	tests := []TestResult{}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return tests, nil
+	}
+	if err != nil {
+		return tests, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var event protocolEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil || event.Type != "result" {
+			continue
+		}
+		tests = append(tests, TestResult{
+			Name:     event.Name,
+			Status:   event.Stat,
+			Logs:     event.Logs,
+			Duration: time.Duration(event.DurationMs * float64(time.Millisecond)),
+		})
+	}
+	return tests, scanner.Err()
+}
+
+// absoluteSourceMap makes the sources of a source map absolute. esbuild
+// writes them relative to its virtual output directory, "/dist", which
+// doesn't match where bundles are written.
+func absoluteSourceMap(path string, data []byte) []byte {
+	var m map[string]interface{}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return data
+	}
+	sources, _ := m["sources"].([]interface{})
+	dir := filepath.Dir(filepath.Join("/dist", filepath.FromSlash(path)))
+	for i, s := range sources {
+		if s, ok := s.(string); ok {
+			abs, err := filepath.Abs(filepath.Join(dir, filepath.FromSlash(s)))
+			if err == nil {
+				sources[i] = abs
+			}
+		}
+	}
+	out, err := json.Marshal(m)
+	if err != nil {
+		return data
+	}
+	return out
+}
+
+func formatMessage(msg esbuild.Message) string {
+	if msg.Location == nil {
+		return msg.Text
+	}
+	return fmt.Sprintf("%s:%d:%d: %s", msg.Location.File, msg.Location.Line, msg.Location.Column, msg.Text)
+}
@@ -0,0 +1,201 @@
+// Package typecheck type-checks projects with the TypeScript compiler they
+// have installed. esbuild only strips types, so nothing else reports type
+// errors.
+//
+// tsc is run with --pretty false, which prints a diagnostic per line:
+//
+//	src/index.ts(3,7): error TS2322: Type 'string' is not assignable to type 'number'.
+//
+// followed by indented lines with more detail, if any.
+package typecheck
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/davezuko/pack/internal/fs"
+	"github.com/davezuko/pack/internal/logger"
+)
+
+// Project is a TypeScript project and the compiler it's checked with.
+type Project struct {
+	// Dir holds the tsconfig.json.
+	Dir string
+	TSC string
+}
+
+// Find finds the project that dir is part of: the closest tsconfig.json in
+// dir or its parents, and the tsc installed in the closest node_modules from
+// there.
+func Find(dir string) (Project, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return Project{}, err
+	}
+	project := Project{Dir: closest(abs, "tsconfig.json")}
+	if project.Dir == "" {
+		return Project{}, fmt.Errorf("no tsconfig.json found in %s or its parents", dir)
+	}
+	bin := filepath.Join("node_modules", ".bin", "tsc")
+	if runtime.GOOS == "windows" {
+		bin += ".cmd"
+	}
+	tscDir := closest(project.Dir, bin)
+	if tscDir == "" {
+		return Project{}, fmt.Errorf("TypeScript isn't installed, add it with `npm install --save-dev typescript`")
+	}
+	project.TSC = filepath.Join(tscDir, bin)
+	return project, nil
+}
+
+// closest returns the closest directory to dir, including itself, that has
+// name in it.
+func closest(dir string, name string) string {
+	for {
+		if fs.Exists(filepath.Join(dir, name)) {
+			return dir
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// Check type-checks the project once.
+func Check(ctx context.Context, p Project) ([]logger.Message, error) {
+	cmd := exec.CommandContext(ctx, p.TSC, "--noEmit", "--pretty", "false", "--project", p.Dir)
+	cmd.Dir = p.Dir
+	out, err := cmd.CombinedOutput()
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	diagnostics := parser{dir: p.Dir}
+	for _, line := range strings.Split(string(out), "\n") {
+		diagnostics.line(line)
+	}
+	msgs := diagnostics.done()
+	// tsc exits with an error when it finds errors, so only fail when it
+	// didn't say why.
+	if err != nil && len(msgs) == 0 {
+		return nil, fmt.Errorf("tsc failed: %s\n%s", err, strings.TrimSpace(string(out)))
+	}
+	return msgs, nil
+}
+
+// watchDone is printed by tsc --watch at the end of every compilation.
+var watchDone = regexp.MustCompile(`Found \d+ errors?\b.*Watching for file changes\.`)
+
+// Watch type-checks the project with tsc --watch, which checks it again
+// whenever a file changes. onResult is called with the diagnostics of every
+// check. Watch returns when ctx is cancelled, or if tsc exits.
+func Watch(ctx context.Context, p Project, onResult func([]logger.Message)) error {
+	cmd := exec.CommandContext(ctx, p.TSC, "--noEmit", "--pretty", "false", "--watch", "--preserveWatchOutput", "--project", p.Dir)
+	cmd.Dir = p.Dir
+	r, w := io.Pipe()
+	cmd.Stdout = w
+	cmd.Stderr = w
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	exited := make(chan error, 1)
+	go func() {
+		err := cmd.Wait()
+		w.Close()
+		exited <- err
+	}()
+
+	output := []string{}
+	diagnostics := parser{dir: p.Dir}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if watchDone.MatchString(line) {
+			onResult(diagnostics.done())
+			diagnostics = parser{dir: p.Dir}
+			output = output[:0]
+			continue
+		}
+		diagnostics.line(line)
+		output = append(output, line)
+	}
+	err := <-exited
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err == nil {
+		err = fmt.Errorf("exited")
+	}
+	return fmt.Errorf("tsc --watch failed: %s\n%s", err, strings.TrimSpace(strings.Join(output, "\n")))
+}
+
+var (
+	locatedDiagnostic = regexp.MustCompile(`^(.+)\((\d+),(\d+)\): (error|warning|message) (TS\d+): (.*)$`)
+	globalDiagnostic  = regexp.MustCompile(`^(error|warning|message) (TS\d+): (.*)$`)
+)
+
+// parser turns the lines tsc prints into messages.
+type parser struct {
+	dir  string
+	msgs []logger.Message
+}
+
+func (p *parser) line(line string) {
+	line = strings.TrimRight(line, "\r")
+	if m := locatedDiagnostic.FindStringSubmatch(line); m != nil {
+		msg := p.message(m[4], m[5], m[6])
+		row, _ := strconv.Atoi(m[2])
+		col, _ := strconv.Atoi(m[3])
+		msg.Data.Location = &logger.MessageLocation{File: p.path(m[1]), Line: row, Column: col}
+		p.msgs = append(p.msgs, msg)
+		return
+	}
+	if m := globalDiagnostic.FindStringSubmatch(line); m != nil {
+		p.msgs = append(p.msgs, p.message(m[1], m[2], m[3]))
+		return
+	}
+	// Details of the previous diagnostic are indented.
+	if strings.HasPrefix(line, " ") && len(p.msgs) > 0 {
+		last := &p.msgs[len(p.msgs)-1]
+		last.Data.Text += "\n" + strings.TrimRight(line, " ")
+	}
+}
+
+func (p *parser) message(category string, code string, text string) logger.Message {
+	kind := logger.Error
+	if category != "error" {
+		kind = logger.Warning
+	}
+	return logger.Message{Kind: kind, Data: logger.MessageData{Text: fmt.Sprintf("%s (%s)", text, code)}}
+}
+
+// path makes the paths tsc prints, which are relative to the project,
+// relative to the working directory instead.
+func (p *parser) path(file string) string {
+	if !filepath.IsAbs(file) {
+		file = filepath.Join(p.dir, file)
+	}
+	if wd, err := os.Getwd(); err == nil {
+		if rel, err := filepath.Rel(wd, file); err == nil && !strings.HasPrefix(rel, "..") {
+			return rel
+		}
+	}
+	return file
+}
+
+func (p *parser) done() []logger.Message {
+	if p.msgs == nil {
+		return []logger.Message{}
+	}
+	return p.msgs
+}
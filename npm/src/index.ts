@@ -1,4 +1,5 @@
 export {TestUtils, TestResult, TestResultStatus} from "./testing/test_utils"
 export {TestSuite} from "./testing/test_suite"
 export {test} from "./testing/test_suite_global"
-export {Assert as assert} from "./testing/assert"
\ No newline at end of file
+export {Assert as assert} from "./testing/assert"
+export {runPlugin, Plugin, Diagnostic} from "./plugins/run_plugin"
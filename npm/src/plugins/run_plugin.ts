@@ -0,0 +1,165 @@
+import * as readline from "readline"
+
+/**
+ * External plugins run in their own process, declared in the project's
+ * pack.json:
+ *
+ * {"plugins": [{"name": "yaml", "command": ["node", "plugins/yaml.js"]}]}
+ *
+ * pack talks to them with JSON-RPC 2.0 over stdin and stdout, one message per
+ * line. runPlugin implements that protocol, so a plugin only needs to define
+ * its hooks. Anything a plugin wants to log should go to stderr.
+ */
+export interface Plugin {
+    /** Called once when the plugin starts. */
+    setup?(options: InitializeParams): void | Promise<void>
+    onResolve?: Array<{
+        filter: string
+        namespace?: string
+        callback(args: ResolveArgs): Maybe<ResolveResult>
+    }>
+    onLoad?: Array<{
+        filter: string
+        namespace?: string
+        callback(args: LoadArgs): Maybe<LoadResult>
+    }>
+    /** Transforms html pages before their scripts and styles are bundled. */
+    transformHTML?(args: TransformHTMLArgs): Maybe<TransformHTMLResult>
+}
+
+type Maybe<T> = T | null | undefined | Promise<T | null | undefined>
+
+export interface InitializeParams {
+    mode: "production" | "development"
+    root: string
+}
+
+export interface Diagnostic {
+    text: string
+    /** Line and column are 1-based. */
+    location?: {file: string; line: number; column: number}
+}
+
+interface Diagnostics {
+    errors?: Diagnostic[]
+    warnings?: Diagnostic[]
+}
+
+export interface ResolveArgs {
+    path: string
+    importer: string
+    namespace: string
+    resolveDir: string
+}
+
+export interface ResolveResult extends Diagnostics {
+    path?: string
+    namespace?: string
+    external?: boolean
+}
+
+export interface LoadArgs {
+    path: string
+    namespace: string
+}
+
+export interface LoadResult extends Diagnostics {
+    contents?: string
+    loader?: "js" | "jsx" | "ts" | "tsx" | "json" | "text" | "base64" | "dataurl" | "file" | "binary" | "css"
+    resolveDir?: string
+}
+
+export interface TransformHTMLArgs {
+    path: string
+    html: string
+}
+
+export interface TransformHTMLResult extends Diagnostics {
+    html?: string
+}
+
+interface Request {
+    id?: number
+    method: string
+    params: any
+}
+
+/** Runs plugin, answering pack's calls until it shuts the plugin down. */
+export function runPlugin(plugin: Plugin) {
+    const lines = readline.createInterface({input: process.stdin})
+    lines.on("line", async (line) => {
+        let req: Request
+        try {
+            req = JSON.parse(line)
+        } catch (e) {
+            return
+        }
+        if (req.method === "shutdown") {
+            lines.close()
+            return
+        }
+        try {
+            const result = await handle(plugin, req)
+            reply({jsonrpc: "2.0", id: req.id, result: result ?? null})
+        } catch (e) {
+            const message = e instanceof Error ? e.stack || e.message : String(e)
+            reply({jsonrpc: "2.0", id: req.id, error: {code: -32000, message}})
+        }
+    })
+}
+
+async function handle(plugin: Plugin, req: Request): Promise<unknown> {
+    switch (req.method) {
+        case "initialize":
+            await plugin.setup?.(req.params)
+            return {
+                onResolve: (plugin.onResolve ?? []).map(filterOf),
+                onLoad: (plugin.onLoad ?? []).map(filterOf),
+                transformHTML: !!plugin.transformHTML,
+            }
+        case "resolve":
+            for (const hook of matching(plugin.onResolve, req.params)) {
+                const result = await hook.callback(req.params)
+                if (result) {
+                    return result
+                }
+            }
+            return null
+        case "load":
+            for (const hook of matching(plugin.onLoad, req.params)) {
+                const result = await hook.callback(req.params)
+                if (result) {
+                    return result
+                }
+            }
+            return null
+        case "transformHTML":
+            return plugin.transformHTML?.(req.params)
+    }
+    throw new Error(`unknown method ${req.method}`)
+}
+
+function filterOf(hook: {filter: string; namespace?: string}) {
+    return {filter: hook.filter, namespace: hook.namespace}
+}
+
+/**
+ * pack calls a hook for every path that matches any of the plugin's filters,
+ * so the filters are checked again to find the hooks that apply. They are Go
+ * regular expressions, which for simple patterns match the same as
+ * JavaScript's.
+ */
+function matching<T extends {filter: string; namespace?: string}>(
+    hooks: T[] | undefined,
+    args: {path: string; namespace: string},
+): T[] {
+    return (hooks ?? []).filter(
+        (hook) =>
+            new RegExp(hook.filter).test(args.path) &&
+            (!hook.namespace || hook.namespace === args.namespace),
+    )
+}
+
+function reply(message: object) {
+    process.stdout.write(JSON.stringify(message) + "\n")
+}
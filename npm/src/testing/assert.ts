@@ -1,5 +1,6 @@
-// @ts-expect-error
-import * as eq from "lodash.isequal"
+// lodash.isequal is a CommonJS function export, which a namespace import
+// doesn't allow calling once bundled.
+import eq = require("lodash.isequal")
 import type {TestUtils} from "./test_utils"
 
 // NOTE: all static methods are explicitly defined as instance methods as well
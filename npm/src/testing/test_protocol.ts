@@ -0,0 +1,48 @@
+import * as fs from "fs"
+import type {TestResult} from "./test_utils"
+
+/**
+ * `pack test` runs every test file in its own node process, and sets
+ * PACK_TEST_PROTOCOL to the path of the file it reads results from. Each
+ * result is appended to it as a line of JSON:
+ *
+ * {"type": "result", "name": "...", "stat": "pass", "logs": [], "durationMs": 1.5}
+ *
+ * Writing to a separate file keeps results apart from whatever tests print to
+ * stdout and stderr.
+ */
+const PROTOCOL_FILE = process.env.PACK_TEST_PROTOCOL || undefined
+
+let protocolFD: number | undefined
+
+/** Whether the tests are being run by `pack test`. */
+export function isProtocolEnabled(): boolean {
+    return PROTOCOL_FILE !== undefined
+}
+
+/** Sends a test result to `pack test`. */
+export function sendResult(result: TestResult, durationMs: number) {
+    if (PROTOCOL_FILE === undefined) {
+        return
+    }
+    if (protocolFD === undefined) {
+        protocolFD = fs.openSync(PROTOCOL_FILE, "a")
+    }
+    const event = {
+        type: "result",
+        name: result.name,
+        stat: result.stat,
+        logs: result.logs,
+        durationMs,
+    }
+    fs.writeSync(protocolFD, JSON.stringify(event) + "\n")
+}
+
+/**
+ * Reports whether the test called name should run. `pack test --run` sets
+ * PACK_TEST_RUN to a regular expression that test names must match.
+ */
+export function shouldRun(name: string): boolean {
+    const pattern = process.env.PACK_TEST_RUN
+    return !pattern || new RegExp(pattern).test(name)
+}
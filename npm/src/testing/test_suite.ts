@@ -1,4 +1,5 @@
-import {Test, TestUtils, TestResult, TestFn} from "./test_utils"
+import {Test, TestUtils, TestResult, TestResultStatus, TestFn} from "./test_utils"
+import {isProtocolEnabled, sendResult, shouldRun} from "./test_protocol"
 
 export class TestSuite {
     private tests: Test[]
@@ -34,7 +35,8 @@ export class TestSuite {
     }
 
     /**
-     * Runs all tests registered in the suite.
+     * Runs all tests registered in the suite. Under `pack test --run`, only
+     * the tests whose name matches the pattern are run.
      */
     run(): Promise<TestResult[]> {
         if (!this.tests.length) {
@@ -42,10 +44,29 @@ export class TestSuite {
         }
 
         return Promise.all(
-            this.tests.map((test) => {
-                const t = new TestUtils(test.name)
-                return test.run(t)
-            }),
+            this.tests
+                .filter((test) => shouldRun(test.name))
+                .map(async (test) => {
+                    const t = new TestUtils(test.name)
+                    const start = Date.now()
+                    let result: TestResult
+                    try {
+                        result = await test.run(t)
+                    } catch (e) {
+                        if (!isProtocolEnabled()) {
+                            throw e
+                        }
+                        // Under `pack test`, an uncaught exception only fails
+                        // its own test so that the others are still reported.
+                        result = {
+                            name: test.name,
+                            stat: TestResultStatus.Fail,
+                            logs: t.logs,
+                        }
+                    }
+                    sendResult(result, Date.now() - start)
+                    return result
+                }),
         )
     }
 }
@@ -1,6 +1,7 @@
 import {TestSuite} from "./test_suite"
 import type {TestFn} from "./test_utils"
 import {report, ReportFormat} from "./test_reporter"
+import {isProtocolEnabled} from "./test_protocol"
 
 let GLOBAL_SUITE: TestSuite | undefined
 let RUNNING_GLOBAL_SUITE = false
@@ -13,7 +14,7 @@ let RUNNING_GLOBAL_SUITE = false
 export function test(name: string, fn: TestFn) {
     if (!GLOBAL_SUITE) {
         initGlobalTestSuite()
-        if (!process.argv.includes("--global")) {
+        if (!process.argv.includes("--global") && !isProtocolEnabled()) {
             console.warn(
                 `------------------------------------------------------------------
 Warning: you called test() outside of a test suite. Your test will
@@ -68,6 +69,10 @@ export function initGlobalTestSuite() {
     Promise.resolve().then(async () => {
         RUNNING_GLOBAL_SUITE = true
         const results = await GLOBAL_SUITE!.run()
+        if (isProtocolEnabled()) {
+            // `pack test` reports the results.
+            return
+        }
 
         let format: ReportFormat
         if (process.argv.includes("--format=json")) {
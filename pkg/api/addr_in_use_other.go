@@ -0,0 +1,15 @@
+//go:build !windows
+// +build !windows
+
+package api
+
+import (
+	"errors"
+	"syscall"
+)
+
+// isAddrInUse reports whether err is from listening on an address that's
+// already in use.
+func isAddrInUse(err error) bool {
+	return errors.Is(err, syscall.EADDRINUSE)
+}
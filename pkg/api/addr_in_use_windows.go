@@ -0,0 +1,17 @@
+package api
+
+import (
+	"errors"
+	"syscall"
+)
+
+// wsaeaddrinuse is the Winsock error of addresses that are already in use.
+// syscall.EADDRINUSE is an invented error number on Windows, which no socket
+// call returns.
+const wsaeaddrinuse = syscall.Errno(10048)
+
+// isAddrInUse reports whether err is from listening on an address that's
+// already in use.
+func isAddrInUse(err error) bool {
+	return errors.Is(err, wsaeaddrinuse)
+}
@@ -1,36 +1,162 @@
 package api
 
+import (
+	"context"
+	"errors"
+)
+
 // NewOptions configures a new project.
 type NewOptions struct {
-	Path     string
+	Path string
+
+	// Template is the name of a built-in template, which needs no network, a
+	// local directory, a .tar.gz, .tgz or .zip archive (local or a url), or a
+	// git repository: a url or "user/repo" on GitHub, optionally followed by
+	// "#ref", "#ref:subdir" or "#:subdir". Defaults to the first built-in
+	// template.
 	Template string
-	Yarn     bool
+
+	// PackageManager installs the dependencies: "npm", "yarn" or "pnpm".
+	// Defaults to the one the template has a lockfile for, or npm.
+	PackageManager string
+	// NoInstall skips installing dependencies.
+	NoInstall bool
+	// GitInit creates a git repository with the project as its first commit.
+	GitInit bool
+
+	// Vars are values for the variables declared by the template in its
+	// pack-template.json manifest.
+	Vars map[string]string
+	// Prompt asks for the value of a template variable that isn't in Vars,
+	// suggesting def. Without it, variables get their default value.
+	Prompt func(name string, message string, def string) (string, error)
+}
+
+// GenerateOptions configures a generator run.
+type GenerateOptions struct {
+	// Dir is the root of the project. Its generators are in
+	// .pack/generators/<kind>.
+	Dir  string
+	Kind string
+	// Name is substituted into the generated files, e.g. "UserProfile".
+	Name string
+}
+
+// GenerateResult lists the files a generator created.
+type GenerateResult struct {
+	// Files are relative to GenerateOptions.Dir.
+	Files []string
 }
 
 // ServeOptions configures the static file server.
 type ServeOptions struct {
+	// Host is the interface to listen on. Use "0.0.0.0" or "::" to make the
+	// server reachable from other devices. Defaults to "localhost".
 	Host string
+	// Port is the port to listen on. When it's in use, the following ports
+	// are tried. Port 0 picks a random free port.
 	Port uint16
 	Open bool
 	Path string
+
+	// PublicPath is the url the build was deployed under (see
+	// BuildOptions.PublicPath). The server mounts the app at its path.
+	PublicPath string
+
+	// Fallback enables history API fallback for single page apps. It maps
+	// path prefixes to the page that is served for missing pages under them,
+	// e.g. {"/": "/index.html", "/admin/": "/admin/index.html"}. The longest
+	// matching prefix wins. Paths with a file extension never fall back.
+	// Missing files that don't fall back are served the site's 404.html.
+	Fallback map[string]string
+
+	// HTTPS serves over TLS, with the certificate in CertFile and KeyFile or,
+	// if they're empty, one issued by a local certificate authority that is
+	// generated on first use and cached. HTTP2 enables HTTP/2, which browsers
+	// only support over HTTPS.
+	HTTPS    bool
+	CertFile string
+	KeyFile  string
+	HTTP2    bool
+
+	// LogFormat enables access logging to stdout: "text", "json" or
+	// "combined" (the Apache/nginx format). Empty disables it.
+	LogFormat string
 }
 
 // ServeResult holds an active HTTP server.
 type ServeResult struct {
 	Host string
+	// Port is the port the server is actually listening on.
 	Port uint16
+	URL  string
+	// NetworkURLs are the urls the server can be reached at from other
+	// devices on the local network. They are only known when listening on
+	// every interface.
+	NetworkURLs []string
+
+	// Wait blocks until the server is stopped. It returns ErrServerStopped
+	// when it was stopped with Stop or by cancelling its context, and the
+	// error that made it fail otherwise.
 	Wait func() error
-	Stop func()
+
+	// Stop stops accepting connections and waits for in-flight requests to
+	// complete. If ctx expires first, the remaining connections are closed
+	// and ctx's error is returned.
+	Stop func(ctx context.Context) error
 }
 
+// ErrServerStopped is returned by ServeResult.Wait after a clean shutdown.
+var ErrServerStopped = errors.New("server stopped")
+
 // StartOptions configures the development server.
 type StartOptions struct {
+	// Host and Port, see ServeOptions.
 	Host      string
 	Port      uint16
 	Open      bool
 	Bundle    bool
 	StaticDir string
 	SourceDir string
+
+	// PublicPath is the url the app will be deployed under (see
+	// BuildOptions.PublicPath). The server mounts the app at its path.
+	PublicPath string
+
+	// Fallback enables history API fallback, see ServeOptions.Fallback.
+	Fallback map[string]string
+
+	// HTTPS options, see ServeOptions.HTTPS.
+	HTTPS    bool
+	CertFile string
+	KeyFile  string
+	HTTP2    bool
+
+	// LogFormat enables access logging, see ServeOptions.LogFormat. The
+	// development server also serves a diagnostics page at /__pack.
+	LogFormat string
+
+	// MocksDir holds mock API responses, which are served instead of
+	// anything else that matches their routes (see internal/mocks for the
+	// format). Routes match full url paths, which include the public path, so
+	// "/api/users" is mocked at the root even with PublicPath "/app/". Mocks
+	// are reloaded when they change, and can be toggled from the diagnostics
+	// page.
+	MocksDir string
+
+	// Network simulates slow or unreliable networks, see NetworkRule. Like
+	// mocks, the rules match full url paths. They can be changed at runtime
+	// from the diagnostics page.
+	Network []NetworkRule
+
+	// Typecheck runs tsc in watch mode alongside the server (see Check).
+	// Type errors are shown in an overlay on the pages of the app, and
+	// OnTypecheck is called with the result of every check.
+	Typecheck   bool
+	OnTypecheck func(CheckResult) `json:"-"`
+
+	// Plugins extend how pages and scripts are built, see Plugin.
+	Plugins []Plugin `json:"-"`
 }
 
 // BuildOptions configures how the project should be built.
@@ -41,6 +167,30 @@ type BuildOptions struct {
 	StaticDir string
 	SourceDir string
 	OutputDir string
+
+	// PublicPath is the url the app will be deployed under, such as "/app/"
+	// or "https://cdn.example.com/app/". Every url that is emitted into html
+	// pages is prefixed with it. Defaults to "/".
+	PublicPath string
+
+	// InlineLimit is the size in bytes up to which inline scripts and styles
+	// stay inline in the html page after being bundled. Larger ones are
+	// emitted as separate files.
+	InlineLimit int
+
+	// Compress writes gzip and brotli compressed copies of compressible
+	// output files next to them (main.js.gz, main.js.br), for servers that
+	// can serve precompressed files. Files smaller than CompressThreshold
+	// bytes are skipped, as are files that barely shrink.
+	Compress          bool
+	CompressThreshold int
+
+	// Typecheck type-checks the project while it's built (see Check). Type
+	// errors fail the build.
+	Typecheck bool
+
+	// Plugins extend the build, see Plugin.
+	Plugins []Plugin
 }
 
 // BuildResult provides diagnostic information about a build.
@@ -52,31 +202,131 @@ type BuildResult struct {
 
 type OutputFile struct {
 	Path string
+	Size int64
+
+	// CompressedSizes maps encodings ("gzip", "br") to the size of the
+	// compressed copies written next to the file (see BuildOptions.Compress).
+	CompressedSizes map[string]int64
 }
 
 type Message struct {
-	Text string
+	Text     string
+	Location *Location
+}
+
+// Location is where in a file a message points to. Line and Column are
+// 1-based.
+type Location struct {
+	File   string
+	Line   int
+	Column int
+}
+
+// CheckOptions configures a type check.
+type CheckOptions struct {
+	// SourceDir is part of the project to check. The closest tsconfig.json
+	// in it or its parents configures the check.
+	SourceDir string
+	// Watch checks the project again whenever a file changes, until ctx is
+	// cancelled.
+	Watch bool
+	// OnResult is called after every check.
+	OnResult func(CheckResult)
+}
+
+// CheckResult holds the diagnostics of a type check. In watch mode, it's the
+// last check.
+type CheckResult struct {
+	Errors   []Message
+	Warnings []Message
+}
+
+// TestOptions configures a test run.
+type TestOptions struct {
+	// SourceDir is where test files are discovered: *_test.ts(x) and
+	// *.test.ts(x).
+	SourceDir string
+	// Run only runs the tests whose name matches this regular expression, in
+	// JavaScript syntax.
+	Run string
+	// Reporter is the format of the report: "pretty" (default), "tap" or
+	// "junit".
+	Reporter string
+	// OutputFile is where the report is written. Defaults to stdout.
+	OutputFile string
+	// Watch runs the tests again whenever a file in SourceDir changes, until
+	// ctx is cancelled.
+	Watch bool
+	// OnResult is called after every run of the tests.
+	OnResult func(TestResult)
+
+	// Coverage collects the code coverage of the sources in SourceDir, mapped
+	// back from the bundles through their source maps. A summary is added to
+	// the pretty report, and lcov.info and an HTML report (index.html) are
+	// written to CoverageDir, which defaults to "coverage".
+	Coverage    bool
+	CoverageDir string
+}
+
+// TestResult summarizes a test run. In watch mode, it's the last run.
+type TestResult struct {
+	Passed  int
+	Failed  int
+	Skipped int
+	// Errors are failures to run the tests at all, e.g. bundling errors.
+	Errors []Message
+	// Coverage is set if TestOptions.Coverage was.
+	Coverage *CoverageSummary
+}
+
+// CoverageSummary holds the percentages of lines and functions that ran.
+type CoverageSummary struct {
+	Lines     float64
+	Functions float64
 }
 
 // Build builds the project to options.OutputDir and optimizes assets for
 // production. The output directory will be a self-contained application
-// and suitable for deployment to a static CDN.
-func Build(opts BuildOptions) BuildResult {
-	return buildImpl(opts)
+// and suitable for deployment to a static CDN. Cancelling ctx aborts the
+// build with an error.
+func Build(ctx context.Context, opts BuildOptions) BuildResult {
+	return buildImpl(ctx, opts)
 }
 
-// Serve serves the assets that were generated from "build".
-func Serve(opts ServeOptions) (ServeResult, error) {
-	return serveImpl(opts)
+// Serve serves the assets that were generated from "build". Cancelling ctx
+// shuts the server down gracefully, see ServeResult.Stop.
+func Serve(ctx context.Context, opts ServeOptions) (ServeResult, error) {
+	return serveImpl(ctx, opts)
 }
 
 // Start starts the development server. Assets in opts.SourceDir are built
 // on demand. Assets in opts.StaticDir are served without modification.
-func Start(opts StartOptions) (ServeResult, error) {
-	return startImpl(opts)
+// Cancelling ctx shuts the server down gracefully, see ServeResult.Stop.
+func Start(ctx context.Context, opts StartOptions) (ServeResult, error) {
+	return startImpl(ctx, opts)
+}
+
+// Check type-checks the project with the TypeScript compiler installed in
+// it, running tsc --noEmit. esbuild strips types without checking them, so
+// builds succeed regardless of type errors.
+func Check(ctx context.Context, opts CheckOptions) CheckResult {
+	return checkImpl(ctx, opts)
+}
+
+// Test runs the tests of the project in node. They are bundled first, and
+// each test file runs in its own process.
+func Test(ctx context.Context, opts TestOptions) TestResult {
+	return testImpl(ctx, opts)
+}
+
+// Generate creates files in a project from one of its generators. Existing
+// files are never overwritten: if any would be, nothing is written.
+func Generate(opts GenerateOptions) (GenerateResult, error) {
+	return generateImpl(opts)
 }
 
-// New creates a new project at the specified path.
-func New(opts NewOptions) error {
-	return newImpl(opts)
+// New creates a new project at the specified path. If anything fails, or
+// ctx is cancelled, the partially created project is removed.
+func New(ctx context.Context, opts NewOptions) error {
+	return newImpl(ctx, opts)
 }
@@ -1,8 +1,11 @@
 package api
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"net"
 	"net/http"
 	"os"
@@ -10,87 +13,150 @@ import (
 	"path"
 	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	esbuild "github.com/evanw/esbuild/pkg/api"
 
 	"github.com/davezuko/pack/internal/bundler"
+	"github.com/davezuko/pack/internal/certs"
+	"github.com/davezuko/pack/internal/compress"
 	"github.com/davezuko/pack/internal/fs"
 	"github.com/davezuko/pack/internal/logger"
+	"github.com/davezuko/pack/internal/scaffold"
+	"github.com/davezuko/pack/templates"
 	"github.com/tdewolff/minify/v2"
 	"github.com/tdewolff/minify/v2/html"
 )
 
-func newImpl(opts NewOptions) error {
+func newImpl(ctx context.Context, opts NewOptions) (err error) {
 	if fs.Exists(opts.Path) {
 		return fmt.Errorf("The destination folder already exists: %s", opts.Path)
 	}
-
-	if !strings.HasPrefix(opts.Template, "http") {
-		opts.Template = "https://github.com/" + opts.Template
+	if opts.Template == "" {
+		opts.Template = templates.Builtin[0].Name
 	}
-	parts := strings.Split(opts.Template, "#")
-	repo := parts[0]
-	var subdir string
-	if len(parts) > 1 {
-		subdir = parts[1]
+	if opts.PackageManager != "" && !scaffold.ValidPackageManager(opts.PackageManager) {
+		return fmt.Errorf("Unknown package manager %q, expected one of: %s", opts.PackageManager, strings.Join(scaffold.PackageManagers, ", "))
+	}
+	source, err := scaffold.ParseSource(opts.Template)
+	if err != nil {
+		return fmt.Errorf("Invalid template: %w", err)
 	}
 
-	fmt.Printf("> Cloning %s into %s\n", repo, opts.Path)
-
-	// Support cloning a subdirectory with the syntax user/repo#directory. We
-	// still have to clone the whole repository, but we do it into a temporary
-	// directory and only copy over the specified subdirectory.
-	if subdir != "" {
-		tmp, err := ioutil.TempDir("", "pack-new")
+	// Don't leave a half-created project behind.
+	defer func() {
 		if err != nil {
-			return err
+			fmt.Printf("> Removing %s\n", opts.Path)
+			os.RemoveAll(opts.Path)
 		}
-		defer os.RemoveAll(tmp)
-		err = exec.Command("git", "clone", "--depth", "1", repo, tmp).Run()
-		if err != nil {
-			return fmt.Errorf("Failed to clone the project template with git: %w", err)
+	}()
+
+	fmt.Printf("> Creating %s from %s\n", opts.Path, source)
+	if err := scaffold.Fetch(source, opts.Path); err != nil {
+		return fmt.Errorf("Failed to create the project from the template: %w", err)
+	}
+	manifest, values, err := renderTemplate(opts)
+	if err != nil {
+		return err
+	}
+	if !opts.NoInstall {
+		manager := opts.PackageManager
+		if manager == "" {
+			manager = scaffold.DetectPackageManager(opts.Path)
 		}
-		err = fs.CopyDir(path.Join(tmp, subdir), opts.Path)
-		if err != nil {
-			return err
+		if err := scaffold.Install(ctx, opts.Path, manager); err != nil {
+			return fmt.Errorf("Failed to install project dependencies: %w", err)
 		}
-	} else {
-		err := exec.Command("git", "clone", "--depth", "1", repo, opts.Path).Run()
-		if err != nil {
-			return fmt.Errorf("Failed to clone the project template with git: %w", err)
+	}
+	if err := manifest.RunPostCreate(ctx, opts.Path, values); err != nil {
+		return err
+	}
+	if opts.GitInit {
+		if err := scaffold.GitInit(ctx, opts.Path); err != nil {
+			return fmt.Errorf("Failed to initialize a git repository: %w", err)
 		}
 	}
+	return ctx.Err()
+}
 
-	err := os.RemoveAll(path.Join(opts.Path, ".git"))
+func generateImpl(opts GenerateOptions) (GenerateResult, error) {
+	if opts.Dir == "" {
+		opts.Dir = "."
+	}
+	files, err := scaffold.Generate(opts.Dir, opts.Kind, opts.Name)
 	if err != nil {
-		return err
+		return GenerateResult{}, err
 	}
+	return GenerateResult{Files: files}, nil
+}
 
-	// Install dependencies
-	// TODO: only do this if package.json exists _and_ there are dependencies
-	fmt.Printf("> Installing node_modules\n")
-	var cmd *exec.Cmd
-	if opts.Yarn {
-		if fs.Exists("package-lock.json") {
-			os.Remove("package-lock.json")
+// renderTemplate substitutes the variables declared by the template's
+// manifest into the project.
+func renderTemplate(opts NewOptions) (scaffold.Manifest, map[string]string, error) {
+	manifest, err := scaffold.ReadManifest(opts.Path)
+	if err != nil {
+		return manifest, nil, fmt.Errorf("Invalid template: %w", err)
+	}
+	var prompt func(scaffold.Variable, string) (string, error)
+	if opts.Prompt != nil {
+		prompt = func(v scaffold.Variable, def string) (string, error) {
+			message := v.Prompt
+			if message == "" {
+				message = v.Name
+			}
+			return opts.Prompt(v.Name, message, def)
 		}
-		cmd = exec.Command("yarn", "install")
-	} else {
-		cmd = exec.Command("npm", "install")
 	}
-	cmd.Dir = opts.Path
-	err = cmd.Run()
-
+	values, err := manifest.Values(opts.Path, opts.Vars, prompt)
 	if err != nil {
-		return fmt.Errorf("Failed to install project dependencies: %s", err)
+		return manifest, nil, err
+	}
+	if err := manifest.Render(opts.Path, values); err != nil {
+		return manifest, nil, fmt.Errorf("Failed to render the template: %w", err)
 	}
-	return nil
+	return manifest, values, nil
 }
 
-func startImpl(opts StartOptions) (ServeResult, error) {
-	b := bundler.New(bundler.NewOptions{Mode: "development"})
+func startImpl(ctx context.Context, opts StartOptions) (ServeResult, error) {
+	// Everything started for the server, such as the type checker, lives
+	// until it's stopped, either by cancelling ctx or by calling Stop.
+	ctx, cancel := context.WithCancel(ctx)
+	mocks := newMockSet(opts.MocksDir)
+	network := newNetworkSim(opts.Network)
+	diagnostics := newDevDiagnostics(opts, mocks, network)
+	plugins := setupPlugins(opts.Plugins, "development")
+	go func() {
+		<-ctx.Done()
+		plugins.disposeAll()
+	}()
+	// Stop and Wait call dispose, so that they return once the plugins are
+	// disposed of.
+	dispose := func() {
+		cancel()
+		plugins.disposeAll()
+	}
+	b := bundler.New(bundler.NewOptions{
+		Mode:    "development",
+		Root:    opts.SourceDir,
+		OnBuild: diagnostics.addBuild,
+		Plugins: plugins.esbuild,
+	})
+	if opts.Typecheck {
+		go checkImpl(ctx, CheckOptions{
+			SourceDir: opts.SourceDir,
+			Watch:     true,
+			OnResult: func(result CheckResult) {
+				diagnostics.setCheck(result)
+				if opts.OnTypecheck != nil {
+					opts.OnTypecheck(result)
+				}
+			},
+		})
+	}
+	base := bundler.PublicPathPrefix(opts.PublicPath)
 	sources := http.FileServer(http.Dir(opts.SourceDir))
 	statics := http.FileServer(http.Dir(opts.StaticDir))
 	handler := http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
@@ -107,60 +173,275 @@ func startImpl(opts StartOptions) (ServeResult, error) {
 		// if file does not exist in the source directory, fall back to serving
 		// it from the static directory.
 		if !fs.Exists(srcPath) {
+			noteRequest(req, "static", 0)
 			statics.ServeHTTP(res, req)
 			return
 		}
 
+		// Directory indexes are only served for canonical urls (with a
+		// trailing slash). Otherwise let the file server redirect.
+		if strings.HasSuffix(req.URL.Path, "/") && fs.Exists(path.Join(srcPath, "index.html")) {
+			query = path.Join(query, "index.html")
+			srcPath = path.Join(srcPath, "index.html")
+		}
+
+		start := time.Now()
 		switch path.Ext(query) {
+		case ".html":
+			result := buildDevPage(plugins, bundler.BundleHTMLOptions{
+				Bundler:     b,
+				Path:        srcPath,
+				Root:        opts.SourceDir,
+				StaticDir:   opts.StaticDir,
+				PublicPath:  opts.PublicPath,
+				Development: true,
+				OnDocument:  plugins.transformHTML(srcPath),
+			})
+			if len(result.Errors) > 0 {
+				diagnostics.addError(srcPath, result.Errors)
+			}
+			noteRequest(req, "page", time.Since(start))
+			if opts.Typecheck && len(result.Errors) == 0 && len(result.OutputFiles) > 0 {
+				page := &result.OutputFiles[len(result.OutputFiles)-1]
+				page.Contents = injectOverlay(page.Contents, base)
+			}
+			serveHTMLResult(res, result)
 		case ".js", ".mjs":
 			// TODO: .js transform behind a flag?
-			serveBundleResult(res, b.Bundle([]string{srcPath}))
+			result := buildDevScript(plugins, b, srcPath)
+			noteRequest(req, "bundle", time.Since(start))
+			serveBundleResult(res, result)
 		case ".ts", ".tsx":
-			serveBundleResult(res, b.Bundle([]string{srcPath}))
+			result := buildDevScript(plugins, b, srcPath)
+			noteRequest(req, "bundle", time.Since(start))
+			serveBundleResult(res, result)
 		default:
+			noteRequest(req, "source", 0)
 			sources.ServeHTTP(res, req)
 		}
 	})
-	return newServer(newServerOpts{
-		Host:    opts.Host,
-		Port:    opts.Port,
-		Open:    opts.Open,
-		Handler: handler,
+	exists := func(p string) bool {
+		return fs.Exists(path.Join(opts.SourceDir, p)) || fs.Exists(path.Join(opts.StaticDir, p))
+	}
+	site := newSiteRules(opts.SourceDir, opts.StaticDir)
+	result, err := newServer(ctx, newServerOpts{
+		Host:       opts.Host,
+		Port:       opts.Port,
+		Open:       opts.Open,
+		PublicPath: opts.PublicPath,
+		HTTPS:      opts.HTTPS,
+		CertFile:   opts.CertFile,
+		KeyFile:    opts.KeyFile,
+		HTTP2:      opts.HTTP2,
+		LogFormat:  opts.LogFormat,
+		Handler:    withDiagnostics(withRules(withFallback(handler, opts.Fallback, exists), site, base, exists), diagnostics).ServeHTTP,
+		// Mocks and network rules match full url paths rather than paths
+		// under the public path, since apps served under one usually still
+		// call their API at the root. The diagnostics page is left alone.
+		Wrap: func(mounted http.Handler) http.Handler {
+			simulated := withNetwork(withMocks(mounted, mocks), network)
+			diagnosticsURL := base + strings.TrimPrefix(diagnosticsPath, "/")
+			return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+				if req.URL.Path == diagnosticsURL || strings.HasPrefix(req.URL.Path, diagnosticsURL+"/") {
+					mounted.ServeHTTP(res, req)
+					return
+				}
+				simulated.ServeHTTP(res, req)
+			})
+		},
 	})
+	if err != nil {
+		dispose()
+		return result, err
+	}
+	wait, stop := result.Wait, result.Stop
+	result.Wait = func() error {
+		err := wait()
+		dispose()
+		return err
+	}
+	result.Stop = func(stopCtx context.Context) error {
+		err := stop(stopCtx)
+		dispose()
+		return err
+	}
+	return result, nil
+}
+
+// buildDevPage builds a page for the development server, running the build
+// hooks of plugins around it.
+func buildDevPage(plugins *pluginHooks, opts bundler.BundleHTMLOptions) bundler.BundleHTMLResult {
+	result := bundler.BundleHTMLResult{Errors: []string{}}
+	for _, msg := range plugins.startBuild() {
+		result.Errors = append(result.Errors, msg.Text)
+	}
+	if len(result.Errors) == 0 {
+		result = bundler.BundleHTML(opts)
+	}
+	if len(result.Errors) == 0 && len(result.OutputFiles) > 0 {
+		page := &result.OutputFiles[len(result.OutputFiles)-1]
+		contents, err := plugins.outputFile(page.Path, page.Contents)
+		if err != nil {
+			result.Errors = append(result.Errors, err.Error())
+		} else {
+			page.Contents = contents
+		}
+	}
+
+	end := BuildResult{Errors: []Message{}, Warnings: []Message{}}
+	for _, text := range result.Errors {
+		end.Errors = append(end.Errors, Message{Text: text})
+	}
+	// The hooks may add, change or remove errors.
+	plugins.endBuild(&end)
+	result.Errors = []string{}
+	for _, msg := range end.Errors {
+		result.Errors = append(result.Errors, msg.Text)
+	}
+	return result
+}
+
+// buildDevScript bundles a script for the development server, running the
+// build hooks of plugins around it.
+func buildDevScript(plugins *pluginHooks, b bundler.Bundler, file string) esbuild.BuildResult {
+	result := esbuild.BuildResult{}
+	for _, msg := range plugins.startBuild() {
+		result.Errors = append(result.Errors, esbuild.Message{Text: msg.Text})
+	}
+	if len(result.Errors) == 0 {
+		result = b.Bundle([]string{file})
+	}
+	for i, f := range result.OutputFiles {
+		contents, err := plugins.outputFile(f.Path, f.Contents)
+		if err != nil {
+			result.Errors = append(result.Errors, esbuild.Message{Text: err.Error()})
+		} else {
+			result.OutputFiles[i].Contents = contents
+		}
+	}
+
+	end := BuildResult{Errors: []Message{}, Warnings: []Message{}}
+	for _, msg := range result.Errors {
+		end.Errors = append(end.Errors, fromESBuildMessage(msg))
+	}
+	for _, msg := range result.Warnings {
+		end.Warnings = append(end.Warnings, fromESBuildMessage(msg))
+	}
+	// The hooks may add, change or remove messages.
+	plugins.endBuild(&end)
+	result.Errors = []esbuild.Message{}
+	for _, msg := range end.Errors {
+		result.Errors = append(result.Errors, toESBuildMessage(msg))
+	}
+	result.Warnings = []esbuild.Message{}
+	for _, msg := range end.Warnings {
+		result.Warnings = append(result.Warnings, toESBuildMessage(msg))
+	}
+	if len(result.Errors) > 0 {
+		result.OutputFiles = nil
+	}
+	return result
+}
+
+func fromESBuildMessage(msg esbuild.Message) Message {
+	m := Message{Text: msg.Text}
+	if loc := msg.Location; loc != nil {
+		m.Location = &Location{File: loc.File, Line: loc.Line, Column: loc.Column + 1}
+	}
+	return m
+}
+
+func toESBuildMessage(msg Message) esbuild.Message {
+	m := esbuild.Message{Text: msg.Text}
+	if loc := msg.Location; loc != nil {
+		m.Location = &esbuild.Location{File: loc.File, Line: loc.Line}
+		if loc.Column > 0 {
+			m.Location.Column = loc.Column - 1
+		}
+	}
+	return m
 }
 
 func serveBundleResult(res http.ResponseWriter, result esbuild.BuildResult) {
-	if len(result.OutputFiles) != 1 {
+	// Stylesheets imported from scripts produce a sibling .css output, which
+	// the browser never asks for in development. Only serve the script.
+	for _, f := range result.OutputFiles {
+		if path.Ext(f.Path) == ".js" {
+			res.Header().Add("Content-Type", "text/javascript")
+			res.Write(f.Contents)
+			return
+		}
+	}
+	res.WriteHeader(http.StatusServiceUnavailable)
+}
+
+func serveHTMLResult(res http.ResponseWriter, result bundler.BundleHTMLResult) {
+	if len(result.Errors) > 0 || len(result.OutputFiles) == 0 {
+		res.Header().Set("Content-Type", "text/plain; charset=utf-8")
 		res.WriteHeader(http.StatusServiceUnavailable)
-	} else {
-		res.Header().Add("Content-Type", "text/javascript")
-		res.Write(result.OutputFiles[0].Contents)
+		res.Write([]byte(strings.Join(result.Errors, "\n")))
+		return
 	}
+	res.Header().Add("Content-Type", "text/html; charset=utf-8")
+	res.Write(result.OutputFiles[len(result.OutputFiles)-1].Contents)
 }
 
-func serveImpl(opts ServeOptions) (ServeResult, error) {
-	statics := http.Dir(opts.Path)
-	handler := http.HandlerFunc(http.FileServer(statics).ServeHTTP)
-	return newServer(newServerOpts{
-		Host:    opts.Host,
-		Port:    opts.Port,
-		Open:    opts.Open,
-		Handler: handler,
+func serveImpl(ctx context.Context, opts ServeOptions) (ServeResult, error) {
+	exists := func(p string) bool {
+		return fs.Exists(path.Join(opts.Path, p))
+	}
+	handler := withFallback(newStaticHandler(opts.Path), opts.Fallback, exists)
+	site := newSiteRules(opts.Path)
+	base := bundler.PublicPathPrefix(opts.PublicPath)
+	return newServer(ctx, newServerOpts{
+		Host:       opts.Host,
+		Port:       opts.Port,
+		Open:       opts.Open,
+		PublicPath: opts.PublicPath,
+		HTTPS:      opts.HTTPS,
+		CertFile:   opts.CertFile,
+		KeyFile:    opts.KeyFile,
+		HTTP2:      opts.HTTP2,
+		LogFormat:  opts.LogFormat,
+		Handler:    withRules(handler, site, base, exists).ServeHTTP,
 	})
 }
 
-func buildImpl(opts BuildOptions) BuildResult {
+func buildImpl(ctx context.Context, opts BuildOptions) BuildResult {
 	log := logger.New()
 	m := minify.New()
 	m.AddFunc("text/html", html.Minify)
+	plugins := setupPlugins(opts.Plugins, "production")
+	defer plugins.disposeAll()
 	b := bundler.New(bundler.NewOptions{
-		Mode:   "production",
-		Minify: opts.Minify,
+		Mode:    "production",
+		Minify:  opts.Minify,
+		Root:    opts.SourceDir,
+		Plugins: plugins.esbuild,
 	})
+	done := func() BuildResult {
+		result := toPublicBuildResult(log)
+		plugins.endBuild(&result)
+		return result
+	}
+	for _, msg := range plugins.startBuild() {
+		log.AddError(msg.Text)
+	}
+	if len(log.Errors()) > 0 {
+		return done()
+	}
+
+	// Type-check alongside the build, which doesn't depend on it.
+	checked := make(chan []logger.Message, 1)
+	if opts.Typecheck {
+		go func() { checked <- checkOnce(ctx, opts.SourceDir) }()
+	} else {
+		checked <- nil
+	}
 
 	if err := fs.Clean(opts.OutputDir); err != nil {
 		log.AddError(fmt.Sprintf("failed to clean output directory: %s", err))
-		return toPublicBuildResult(log)
+		return done()
 	}
 	if fs.Exists(opts.StaticDir) {
 		if err := fs.CopyDir(opts.StaticDir, opts.OutputDir); err != nil {
@@ -172,6 +453,9 @@ func buildImpl(opts BuildOptions) BuildResult {
 
 	// TODO: consider sending writable assets to channel, not writing directly
 	filepath.Walk(opts.SourceDir, func(path string, info os.FileInfo, _ error) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 		if info.IsDir() {
 			return nil
 		}
@@ -188,9 +472,14 @@ func buildImpl(opts BuildOptions) BuildResult {
 			go func() {
 				defer wg.Done()
 				result := bundler.BundleHTML(bundler.BundleHTMLOptions{
-					Bundler: b,
-					Path:    path,
-					Root:    opts.SourceDir,
+					Bundler:     b,
+					Path:        path,
+					Root:        opts.SourceDir,
+					StaticDir:   opts.StaticDir,
+					PublicPath:  opts.PublicPath,
+					Hash:        opts.Hash,
+					InlineLimit: opts.InlineLimit,
+					OnDocument:  plugins.transformHTML(path),
 				})
 				if len(result.Errors) > 0 {
 					err := "failed to build " + path
@@ -200,6 +489,7 @@ func buildImpl(opts BuildOptions) BuildResult {
 					log.AddError(err)
 				} else {
 					for _, f := range result.OutputFiles {
+						rel := f.Path
 						f.Path = filepath.Join(opts.OutputDir, f.Path)
 						if opts.Minify {
 							if filepath.Ext(f.Path) == ".html" {
@@ -211,7 +501,13 @@ func buildImpl(opts BuildOptions) BuildResult {
 								}
 							}
 						}
-						err := fs.WriteFile(f.Path, f.Contents, 0755)
+						contents, err := plugins.outputFile(rel, f.Contents)
+						if err != nil {
+							log.AddError(err.Error())
+							continue
+						}
+						f.Contents = contents
+						err = fs.WriteFile(f.Path, f.Contents, 0755)
 						if err != nil {
 							log.AddError(fmt.Sprintf("failed to write %s: %s", f.Path, err.Error()))
 						}
@@ -225,7 +521,10 @@ func buildImpl(opts BuildOptions) BuildResult {
 				defer wg.Done()
 				outFile, _ := filepath.Rel(opts.SourceDir, path)
 				outFile = filepath.Join(opts.OutputDir, outFile)
-				err := fs.CopyFile(path, outFile)
+				err := os.MkdirAll(filepath.Dir(outFile), 0755)
+				if err == nil {
+					err = fs.CopyFile(path, outFile)
+				}
 				if err != nil {
 					log.AddError(fmt.Sprintf("could not copy %s: %s", outFile, err))
 				} else {
@@ -236,63 +535,305 @@ func buildImpl(opts BuildOptions) BuildResult {
 		return nil
 	})
 	wg.Wait()
-	return toPublicBuildResult(log)
+	if ctx.Err() != nil {
+		log.AddError(fmt.Sprintf("build cancelled: %s", ctx.Err()))
+		return done()
+	}
+	checkRules(opts.OutputDir, log)
+	for _, msg := range <-checked {
+		log.AddMessage(msg)
+	}
+	var outputFiles []OutputFile
+	if len(log.Errors()) == 0 {
+		outputFiles = compressOutputFiles(opts, log)
+	}
+	result := done()
+	result.OutputFiles = outputFiles
+	return result
+}
+
+// minCompressRatio is the largest compressed to original size ratio at which
+// a compressed copy of a file is still worth writing.
+const minCompressRatio = 0.9
+
+// compressOutputFiles lists every file in the output directory and, with
+// opts.Compress, writes compressed copies of them.
+func compressOutputFiles(opts BuildOptions, log logger.Log) []OutputFile {
+	files := []OutputFile{}
+	filepath.Walk(opts.OutputDir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			files = append(files, OutputFile{Path: path, Size: info.Size()})
+		}
+		return nil
+	})
+	if !opts.Compress {
+		return files
+	}
+
+	var wg sync.WaitGroup
+	for i := range files {
+		f := &files[i]
+		if f.Size < int64(opts.CompressThreshold) || !compress.Compressible(f.Path) {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			data, err := ioutil.ReadFile(f.Path)
+			if err != nil {
+				log.AddError(fmt.Sprintf("failed to compress %s: %s", f.Path, err))
+				return
+			}
+			for _, enc := range compress.Encodings {
+				compressed, err := enc.Compress(data)
+				if err != nil {
+					log.AddError(fmt.Sprintf("failed to compress %s: %s", f.Path, err))
+					return
+				}
+				if float64(len(compressed)) > float64(len(data))*minCompressRatio {
+					continue
+				}
+				if err := ioutil.WriteFile(f.Path+enc.Ext, compressed, 0644); err != nil {
+					log.AddError(fmt.Sprintf("failed to write %s: %s", f.Path+enc.Ext, err))
+					return
+				}
+				if f.CompressedSizes == nil {
+					f.CompressedSizes = map[string]int64{}
+				}
+				f.CompressedSizes[enc.Name] = int64(len(compressed))
+			}
+		}()
+	}
+	wg.Wait()
+	return files
 }
 
 func toPublicBuildResult(log logger.Log) BuildResult {
 	result := BuildResult{}
 	result.Errors = make([]Message, len(log.Errors()))
 	for i, msg := range log.Errors() {
-		result.Errors[i] = Message{Text: msg.Data.Text}
+		result.Errors[i] = toPublicMessage(msg)
 	}
 	result.Warnings = make([]Message, len(log.Warnings()))
 	for i, msg := range log.Warnings() {
-		result.Warnings[i] = Message{Text: msg.Data.Text}
+		result.Warnings[i] = toPublicMessage(msg)
 	}
 	return result
 }
 
 type newServerOpts struct {
-	Host    string
-	Port    uint16
-	Open    bool
-	Handler http.HandlerFunc
+	Host       string
+	Port       uint16
+	Open       bool
+	PublicPath string
+	HTTPS      bool
+	CertFile   string
+	KeyFile    string
+	HTTP2      bool
+	LogFormat  string
+	Handler    http.HandlerFunc
+	// Wrap, if any, wraps Handler once it's mounted at the public path, so
+	// that it sees full url paths.
+	Wrap func(http.Handler) http.Handler
 }
 
-func newServer(opts newServerOpts) (ServeResult, error) {
+func newServer(ctx context.Context, opts newServerOpts) (ServeResult, error) {
 	if opts.Host == "" {
 		opts.Host = "localhost"
 	}
-	if opts.Port == 0 {
-		opts.Port = 3000
+	if opts.HTTP2 && !opts.HTTPS {
+		return ServeResult{}, fmt.Errorf("HTTP/2 requires HTTPS")
+	}
+	if err := validateLogFormat(opts.LogFormat); err != nil {
+		return ServeResult{}, err
+	}
+
+	base := bundler.PublicPathPrefix(opts.PublicPath)
+	handler := mount(base, opts.Handler)
+	if opts.Wrap != nil {
+		handler = opts.Wrap(handler)
+	}
+	server := &http.Server{Handler: withLogging(handler, opts.LogFormat, os.Stdout)}
+	scheme := "http"
+	if opts.HTTPS {
+		config, err := newTLSConfig(opts)
+		if err != nil {
+			return ServeResult{}, err
+		}
+		server.TLSConfig = config
+		scheme = "https"
+	}
+	if !opts.HTTP2 {
+		// A non-nil map disables the automatic HTTP/2 support of ServeTLS.
+		server.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
 	}
-	url := fmt.Sprintf("%s:%d", opts.Host, opts.Port)
-	listener, err := net.Listen("tcp", url)
+
+	listener, err := listen(opts.Host, opts.Port)
 	if err != nil {
 		return ServeResult{}, err
 	}
+	port := strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)
+
+	// Servers listening on every interface are browsed through localhost,
+	// and from other devices through the machine's LAN addresses.
+	host := opts.Host
+	networkURLs := []string{}
+	if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+		host = "localhost"
+		for _, lan := range lanIPs() {
+			if ip.To4() != nil && net.ParseIP(lan).To4() == nil {
+				// 0.0.0.0 only listens on IPv4 interfaces.
+				continue
+			}
+			networkURLs = append(networkURLs, scheme+"://"+net.JoinHostPort(lan, port)+base)
+		}
+	}
 
-	wait := make(chan error, 1)
+	// Shutdown returns as soon as Serve does, so Wait needs to be told when
+	// the in-flight requests have drained.
+	drained := make(chan struct{})
+	var stopOnce sync.Once
+	var stopErr error
+	stop := func(ctx context.Context) error {
+		stopOnce.Do(func() {
+			stopErr = server.Shutdown(ctx)
+			if stopErr != nil {
+				server.Close()
+			}
+			close(drained)
+		})
+		return stopErr
+	}
+
+	done := make(chan struct{})
+	var waitErr error
 	result := ServeResult{
-		Host: opts.Host,
-		Port: opts.Port,
-		Wait: func() error { return <-wait },
-		Stop: func() { listener.Close() },
+		Host:        host,
+		Port:        uint16(listener.Addr().(*net.TCPAddr).Port),
+		URL:         scheme + "://" + net.JoinHostPort(host, port) + base,
+		NetworkURLs: networkURLs,
+		Wait: func() error {
+			<-done
+			return waitErr
+		},
+		Stop: stop,
 	}
 	go func() {
-		err := http.Serve(listener, opts.Handler)
-		if err != http.ErrServerClosed {
-			wait <- err
+		var err error
+		if opts.HTTPS {
+			err = server.ServeTLS(listener, "", "")
 		} else {
-			wait <- nil
+			err = server.Serve(listener)
+		}
+		if err == http.ErrServerClosed {
+			<-drained
+			err = ErrServerStopped
+		}
+		waitErr = err
+		close(done)
+	}()
+	go func() {
+		select {
+		case <-ctx.Done():
+			drainCtx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+			defer cancel()
+			stop(drainCtx)
+		case <-done:
 		}
 	}()
 	if opts.Open {
-		open("http://" + url)
+		open(result.URL)
 	}
 	return result, nil
 }
 
+// drainTimeout is how long in-flight requests are given to complete when the
+// server's context is cancelled.
+const drainTimeout = 5 * time.Second
+
+// maxPortAttempts is the number of consecutive ports tried when the
+// requested one is already in use.
+const maxPortAttempts = 20
+
+// listen listens on port, or on the next free one if it's already in use.
+// Port 0 picks a random free port.
+func listen(host string, port uint16) (net.Listener, error) {
+	for i := 0; ; i++ {
+		listener, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(int(port)+i)))
+		if err == nil || port == 0 || i+1 == maxPortAttempts || int(port)+i == math.MaxUint16 || !isAddrInUse(err) {
+			return listener, err
+		}
+	}
+}
+
+// newTLSConfig loads the certificate given by the user or issues one from
+// the local certificate authority, valid for every address the server can be
+// reached at.
+func newTLSConfig(opts newServerOpts) (*tls.Config, error) {
+	if opts.CertFile != "" || opts.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load the TLS certificate: %w", err)
+		}
+		return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+	}
+
+	hosts := []string{"localhost", "127.0.0.1", "::1"}
+	switch opts.Host {
+	case "", "localhost", "127.0.0.1", "::1", "0.0.0.0", "::":
+	default:
+		hosts = append(hosts, opts.Host)
+	}
+	hosts = append(hosts, lanIPs()...)
+	result, err := certs.Local(certs.Dir(), hosts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create a local TLS certificate: %w", err)
+	}
+	if result.CACreated {
+		fmt.Printf("Created a local certificate authority at %s\n", result.CAFile)
+		fmt.Printf("Add it to the trusted certificates of your browsers and devices to avoid security warnings.\n\n")
+	}
+	return &tls.Config{Certificates: []tls.Certificate{result.Certificate}}, nil
+}
+
+// lanIPs returns the addresses the machine can be reached at on the local
+// network.
+func lanIPs() []string {
+	ips := []string{}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return ips
+	}
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || ipnet.IP.IsLoopback() || ipnet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		ips = append(ips, ipnet.IP.String())
+	}
+	return ips
+}
+
+// mount serves handler under the path prefix base, which has leading and
+// trailing slashes. Requests outside of it are redirected to base when they
+// are for the site root, and are not found otherwise.
+func mount(base string, handler http.Handler) http.Handler {
+	if base == "/" {
+		return handler
+	}
+	stripped := http.StripPrefix(strings.TrimSuffix(base, "/"), handler)
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		switch {
+		case strings.HasPrefix(req.URL.Path, base):
+			stripped.ServeHTTP(res, req)
+		case req.URL.Path == "/" || req.URL.Path+"/" == base:
+			http.Redirect(res, req, base, http.StatusFound)
+		default:
+			http.NotFound(res, req)
+		}
+	})
+}
+
 func open(url string) error {
 	var cmd string
 	var args []string
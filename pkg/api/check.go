@@ -0,0 +1,133 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	"github.com/davezuko/pack/internal/logger"
+	"github.com/davezuko/pack/internal/typecheck"
+)
+
+func checkImpl(ctx context.Context, opts CheckOptions) CheckResult {
+	result := CheckResult{Errors: []Message{}, Warnings: []Message{}}
+	report := func(msgs []logger.Message) {
+		result = toCheckResult(msgs)
+		if opts.OnResult != nil {
+			opts.OnResult(result)
+		}
+	}
+	if !opts.Watch {
+		report(checkOnce(ctx, opts.SourceDir))
+		return result
+	}
+	project, err := typecheck.Find(opts.SourceDir)
+	if err == nil {
+		err = typecheck.Watch(ctx, project, report)
+	}
+	if err != nil && ctx.Err() == nil {
+		report([]logger.Message{checkError(err)})
+	}
+	return result
+}
+
+// checkOnce type-checks the project that dir is part of. Failing to run tsc
+// is reported as an error.
+func checkOnce(ctx context.Context, dir string) []logger.Message {
+	project, err := typecheck.Find(dir)
+	if err != nil {
+		return []logger.Message{checkError(err)}
+	}
+	msgs, err := typecheck.Check(ctx, project)
+	if err != nil {
+		return []logger.Message{checkError(err)}
+	}
+	return msgs
+}
+
+func checkError(err error) logger.Message {
+	return logger.Message{Kind: logger.Error, Data: logger.MessageData{Text: fmt.Sprintf("failed to type-check: %s", err)}}
+}
+
+func toCheckResult(msgs []logger.Message) CheckResult {
+	result := CheckResult{Errors: []Message{}, Warnings: []Message{}}
+	for _, msg := range msgs {
+		if msg.Kind == logger.Error {
+			result.Errors = append(result.Errors, toPublicMessage(msg))
+		} else {
+			result.Warnings = append(result.Warnings, toPublicMessage(msg))
+		}
+	}
+	return result
+}
+
+func toPublicMessage(msg logger.Message) Message {
+	m := Message{Text: msg.Data.Text}
+	if loc := msg.Data.Location; loc != nil {
+		m.Location = &Location{File: loc.File, Line: loc.Line, Column: loc.Column}
+	}
+	return m
+}
+
+// injectOverlay adds the error overlay script to an html page of the
+// development server. base is the path the app is mounted at.
+func injectOverlay(page []byte, base string) []byte {
+	tag := []byte(fmt.Sprintf(`<script src="%s__pack/overlay.js"></script>`, base))
+	if i := bytes.LastIndex(page, []byte("</body>")); i >= 0 {
+		return append(page[:i:i], append(tag, page[i:]...)...)
+	}
+	return append(page, tag...)
+}
+
+// overlayScript shows the type errors of the development server on top of
+// the page. It polls for them, so the overlay appears and disappears as
+// files are fixed, without reloading.
+const overlayScript = `(function () {
+  var url = new URL("check.json", document.currentScript.src).href;
+  var last = "";
+  var root = document.createElement("div");
+  root.id = "__pack-overlay";
+  root.style.cssText = "position:fixed;inset:0;z-index:2147483647;overflow:auto;" +
+    "background:rgba(20,20,20,.92);color:#eee;font:13px/1.5 ui-monospace,monospace;padding:2em;";
+  root.addEventListener("click", function (e) {
+    if (e.target.dataset.close) root.remove();
+  });
+
+  function render(result) {
+    var errors = result.Errors || [];
+    var key = JSON.stringify(errors);
+    if (key === last) return;
+    last = key;
+    if (errors.length === 0) {
+      root.remove();
+      return;
+    }
+    root.textContent = "";
+    var title = document.createElement("div");
+    title.style.cssText = "color:#ff6b6b;font-size:16px;margin-bottom:1em;";
+    title.textContent = errors.length + (errors.length === 1 ? " type error" : " type errors") + " ";
+    var close = document.createElement("button");
+    close.textContent = "Dismiss";
+    close.dataset.close = "1";
+    title.appendChild(close);
+    root.appendChild(title);
+    errors.forEach(function (msg) {
+      var item = document.createElement("pre");
+      item.style.cssText = "white-space:pre-wrap;margin:0 0 1em;";
+      var loc = msg.Location;
+      item.textContent = (loc ? loc.File + ":" + loc.Line + ":" + loc.Column + ": " : "") + msg.Text;
+      root.appendChild(item);
+    });
+    document.body.appendChild(root);
+  }
+
+  function poll() {
+    fetch(url, {cache: "no-store"})
+      .then(function (res) { return res.json(); })
+      .then(render)
+      .catch(function () {})
+      .then(function () { setTimeout(poll, 1000); });
+  }
+  poll();
+})();
+`
@@ -0,0 +1,230 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+	esbuild "github.com/evanw/esbuild/pkg/api"
+	"golang.org/x/net/html"
+
+	"github.com/davezuko/pack/internal/rpcplugin"
+)
+
+// ConfigFile is the name of the project configuration file, which is read
+// from the project's root directory.
+const ConfigFile = "pack.json"
+
+// Config is the project configuration:
+//
+//	{
+//	  "plugins": [
+//	    {"name": "yaml", "command": ["node", "plugins/yaml.js"], "timeout": "30s"}
+//	  ]
+//	}
+type Config struct {
+	Plugins []ExternalPlugin `json:"plugins"`
+}
+
+// ExternalPlugin is a plugin that runs in a process of its own, and is
+// talked to with JSON-RPC over stdin and stdout (see internal/rpcplugin for
+// the protocol). It's started once per Build, and once for the lifetime of
+// the development server, which reuses it for every rebuild.
+type ExternalPlugin struct {
+	Name string `json:"name"`
+	// Command is the program to run and its arguments. It runs in Dir, which
+	// is the project's root directory when read from the configuration.
+	Command []string `json:"command"`
+	Dir     string   `json:"-"`
+	// Timeout is how long each call to the plugin may take, such as "30s".
+	// Defaults to 10s.
+	Timeout string `json:"timeout"`
+}
+
+// LoadConfig reads the configuration of the project in dir. A project
+// without a configuration file has an empty one.
+func LoadConfig(dir string) (Config, error) {
+	config := Config{Plugins: []ExternalPlugin{}}
+	file := filepath.Join(dir, ConfigFile)
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return config, nil
+	}
+	if err != nil {
+		return config, err
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return config, fmt.Errorf("invalid %s: %w", file, err)
+	}
+	for i := range config.Plugins {
+		p := &config.Plugins[i]
+		p.Dir = dir
+		switch {
+		case p.Name == "":
+			return config, fmt.Errorf("invalid %s: plugin %d has no name", file, i+1)
+		case len(p.Command) == 0:
+			return config, fmt.Errorf("invalid %s: plugin %q has no command", file, p.Name)
+		}
+		if p.Timeout != "" {
+			timeout, err := time.ParseDuration(p.Timeout)
+			if err != nil {
+				return config, fmt.Errorf("invalid %s: plugin %q has an invalid timeout: %w", file, p.Name, err)
+			}
+			if timeout <= 0 {
+				return config, fmt.Errorf("invalid %s: plugin %q has a timeout of %s, which must be positive", file, p.Name, p.Timeout)
+			}
+		}
+	}
+	return config, nil
+}
+
+// Plugin returns the plugin that runs the external plugin. Its hooks are
+// the ones the plugin asks for when it starts.
+func (e ExternalPlugin) Plugin() Plugin {
+	return Plugin{Name: e.Name, Setup: func(build PluginBuild) {
+		timeout, _ := time.ParseDuration(e.Timeout)
+		root, _ := filepath.Abs(e.Dir)
+		client, err := rpcplugin.Start(rpcplugin.Config{
+			Name:    e.Name,
+			Command: e.Command,
+			Dir:     e.Dir,
+			Timeout: timeout,
+		}, rpcplugin.InitializeParams{Mode: build.Mode, Root: root})
+		if err != nil {
+			// Fail every build rather than ignoring the plugin.
+			build.OnStart(func() error { return err })
+			return
+		}
+		build.OnDispose(func() { client.Close() })
+
+		caps := client.Capabilities()
+		for _, f := range caps.OnResolve {
+			build.OnResolve(OnResolveOptions{Filter: f.Filter, Namespace: f.Namespace}, func(args OnResolveArgs) (OnResolveResult, error) {
+				r, err := client.Resolve(rpcplugin.ResolveParams{
+					Path:       args.Path,
+					Importer:   args.Importer,
+					Namespace:  args.Namespace,
+					ResolveDir: args.ResolveDir,
+				})
+				if err != nil {
+					return OnResolveResult{}, err
+				}
+				return OnResolveResult{
+					Path:      r.Path,
+					Namespace: r.Namespace,
+					External:  r.External,
+					Errors:    toESBuildMessages(r.Errors),
+					Warnings:  toESBuildMessages(r.Warnings),
+				}, nil
+			})
+		}
+		for _, f := range caps.OnLoad {
+			build.OnLoad(OnLoadOptions{Filter: f.Filter, Namespace: f.Namespace}, func(args OnLoadArgs) (OnLoadResult, error) {
+				r, err := client.Load(rpcplugin.LoadParams{Path: args.Path, Namespace: args.Namespace})
+				if err != nil {
+					return OnLoadResult{}, err
+				}
+				loader, ok := loaders[r.Loader]
+				if !ok {
+					return OnLoadResult{}, fmt.Errorf("unknown loader %q", r.Loader)
+				}
+				return OnLoadResult{
+					Contents:   r.Contents,
+					Loader:     loader,
+					ResolveDir: r.ResolveDir,
+					Errors:     toESBuildMessages(r.Errors),
+					Warnings:   toESBuildMessages(r.Warnings),
+				}, nil
+			})
+		}
+		if caps.TransformHTML {
+			build.OnHTML(func(args HTMLArgs) error {
+				page, err := args.Doc.Html()
+				if err != nil {
+					return err
+				}
+				r, err := client.TransformHTML(rpcplugin.TransformHTMLParams{Path: args.Path, HTML: page})
+				if err != nil {
+					return err
+				}
+				for _, w := range r.Warnings {
+					fmt.Fprintf(os.Stderr, "[warning]: %s\n", formatDiagnostic(w))
+				}
+				if len(r.Errors) > 0 {
+					texts := []string{}
+					for _, d := range r.Errors {
+						texts = append(texts, formatDiagnostic(d))
+					}
+					return fmt.Errorf("%s", strings.Join(texts, "\n"))
+				}
+				if r.HTML != nil {
+					return replaceDocument(args.Doc, *r.HTML)
+				}
+				return nil
+			})
+		}
+	}}
+}
+
+// loaders maps the loader names of external plugins to esbuild's loaders.
+// No loader is the same as "js".
+var loaders = map[string]esbuild.Loader{
+	"":        esbuild.LoaderNone,
+	"js":      esbuild.LoaderJS,
+	"jsx":     esbuild.LoaderJSX,
+	"ts":      esbuild.LoaderTS,
+	"tsx":     esbuild.LoaderTSX,
+	"json":    esbuild.LoaderJSON,
+	"text":    esbuild.LoaderText,
+	"base64":  esbuild.LoaderBase64,
+	"dataurl": esbuild.LoaderDataURL,
+	"file":    esbuild.LoaderFile,
+	"binary":  esbuild.LoaderBinary,
+	"css":     esbuild.LoaderCSS,
+}
+
+func toESBuildMessages(diagnostics []rpcplugin.Diagnostic) []esbuild.Message {
+	msgs := []esbuild.Message{}
+	for _, d := range diagnostics {
+		msg := esbuild.Message{Text: d.Text}
+		if loc := d.Location; loc != nil {
+			msg.Location = &esbuild.Location{File: loc.File, Line: loc.Line}
+			// esbuild's columns are 0-based.
+			if loc.Column > 0 {
+				msg.Location.Column = loc.Column - 1
+			}
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs
+}
+
+func formatDiagnostic(d rpcplugin.Diagnostic) string {
+	if d.Location == nil {
+		return d.Text
+	}
+	return fmt.Sprintf("%s:%d:%d: %s", d.Location.File, d.Location.Line, d.Location.Column, d.Text)
+}
+
+// replaceDocument replaces the contents of doc with the parsed page.
+func replaceDocument(doc *goquery.Document, page string) error {
+	parsed, err := html.Parse(bytes.NewBufferString(page))
+	if err != nil {
+		return err
+	}
+	root := doc.Nodes[0]
+	for c := root.FirstChild; c != nil; c = root.FirstChild {
+		root.RemoveChild(c)
+	}
+	for c := parsed.FirstChild; c != nil; c = parsed.FirstChild {
+		parsed.RemoveChild(c)
+		root.AppendChild(c)
+	}
+	return nil
+}
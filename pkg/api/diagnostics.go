@@ -0,0 +1,333 @@
+package api
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/davezuko/pack/internal/bundler"
+)
+
+// diagnosticsPath is where the development server serves its diagnostics
+// page. The same data is available as JSON at diagnosticsPath/state.json.
+const diagnosticsPath = "/__pack"
+
+// maxRecentBuilds is the number of builds and errors kept for the
+// diagnostics page.
+const maxRecentBuilds = 50
+
+// devDiagnostics collects what the development server has been doing.
+type devDiagnostics struct {
+	opts    StartOptions
+	started time.Time
+	mocks   *mockSet
+	network *networkSim
+
+	mu     sync.Mutex
+	builds []bundler.BuildInfo
+	errors []devError
+	// graph is the module graph of the latest build of each entry.
+	graph map[string]bundler.BuildInfo
+	// check is the latest type check, if StartOptions.Typecheck is set.
+	check CheckResult
+}
+
+type devError struct {
+	Time   time.Time `json:"time"`
+	Path   string    `json:"path"`
+	Errors []string  `json:"errors"`
+}
+
+func newDevDiagnostics(opts StartOptions, mocks *mockSet, network *networkSim) *devDiagnostics {
+	return &devDiagnostics{
+		opts:    opts,
+		started: time.Now(),
+		mocks:   mocks,
+		network: network,
+		graph:   map[string]bundler.BuildInfo{},
+		check:   CheckResult{Errors: []Message{}, Warnings: []Message{}},
+	}
+}
+
+func (d *devDiagnostics) addBuild(info bundler.BuildInfo) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.builds = append(d.builds, info)
+	if len(d.builds) > maxRecentBuilds {
+		d.builds = d.builds[1:]
+	}
+	d.graph[strings.Join(info.Entries, ",")] = info
+}
+
+func (d *devDiagnostics) addError(path string, errors []string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.errors = append(d.errors, devError{Time: time.Now(), Path: path, Errors: errors})
+	if len(d.errors) > maxRecentBuilds {
+		d.errors = d.errors[1:]
+	}
+}
+
+func (d *devDiagnostics) setCheck(result CheckResult) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.check = result
+}
+
+func (d *devDiagnostics) lastCheck() CheckResult {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.check
+}
+
+// devState is the content of the diagnostics page.
+type devState struct {
+	Config  StartOptions        `json:"config"`
+	Started time.Time           `json:"started"`
+	Builds  []devBuild          `json:"builds"`
+	Errors  []devError          `json:"errors"`
+	Modules map[string][]string `json:"modules"`
+	Mocks   []devMock           `json:"mocks"`
+	Network []NetworkRule       `json:"network"`
+	Check   *CheckResult        `json:"check,omitempty"`
+}
+
+type devMock struct {
+	ID      string `json:"id"`
+	Method  string `json:"method"`
+	Path    string `json:"path"`
+	Status  int    `json:"status"`
+	Enabled bool   `json:"enabled"`
+}
+
+type devBuild struct {
+	Entries    []string       `json:"entries"`
+	Time       time.Time      `json:"time"`
+	DurationMs float64        `json:"durationMs"`
+	Errors     []string       `json:"errors"`
+	Warnings   []string       `json:"warnings"`
+	Outputs    map[string]int `json:"outputs"`
+}
+
+func (d *devDiagnostics) state() devState {
+	routes := d.mocks.load()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	state := devState{
+		Config:  d.opts,
+		Started: d.started,
+		Builds:  []devBuild{},
+		Errors:  append([]devError{}, d.errors...),
+		Modules: map[string][]string{},
+		Mocks:   []devMock{},
+		Network: d.network.get(),
+	}
+	if d.opts.Typecheck {
+		check := d.check
+		state.Check = &check
+	}
+	for _, r := range routes {
+		state.Mocks = append(state.Mocks, devMock{
+			ID:      r.ID(),
+			Method:  r.Method,
+			Path:    r.Path,
+			Status:  r.Status,
+			Enabled: r.Enabled,
+		})
+	}
+	// Most recent first.
+	for i := len(d.builds) - 1; i >= 0; i-- {
+		b := d.builds[i]
+		state.Builds = append(state.Builds, devBuild{
+			Entries:    b.Entries,
+			Time:       b.Start,
+			DurationMs: float64(b.Duration.Microseconds()) / 1000,
+			Errors:     b.Errors,
+			Warnings:   b.Warnings,
+			Outputs:    b.Outputs,
+		})
+	}
+	sort.Slice(state.Errors, func(i, j int) bool { return state.Errors[i].Time.After(state.Errors[j].Time) })
+	for _, b := range d.graph {
+		for input, imports := range b.Imports {
+			state.Modules[input] = imports
+		}
+	}
+	return state
+}
+
+// withDiagnostics serves the diagnostics page, and passes other requests on
+// to handler.
+func withDiagnostics(handler http.Handler, d *devDiagnostics) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case diagnosticsPath:
+			noteRequest(req, "diagnostics", 0)
+			res.Header().Set("Content-Type", "text/html; charset=utf-8")
+			res.Header().Set("Cache-Control", "no-store")
+			if err := diagnosticsPage.Execute(res, d.state()); err != nil {
+				http.Error(res, err.Error(), http.StatusInternalServerError)
+			}
+		case diagnosticsPath + "/state.json":
+			noteRequest(req, "diagnostics", 0)
+			res.Header().Set("Content-Type", "application/json")
+			res.Header().Set("Cache-Control", "no-store")
+			enc := json.NewEncoder(res)
+			enc.SetIndent("", "  ")
+			enc.Encode(d.state())
+		case diagnosticsPath + "/overlay.js":
+			res.Header().Set("Content-Type", "text/javascript")
+			res.Header().Set("Cache-Control", "no-store")
+			res.Write([]byte(overlayScript))
+		case diagnosticsPath + "/check.json":
+			res.Header().Set("Content-Type", "application/json")
+			res.Header().Set("Cache-Control", "no-store")
+			json.NewEncoder(res).Encode(d.lastCheck())
+		case diagnosticsPath + "/mocks":
+			// Toggles a mock: POST route=<id>&enabled=true|false
+			if req.Method != "POST" {
+				http.Error(res, "405 - Method Not Allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			noteRequest(req, "diagnostics", 0)
+			if !d.mocks.toggle(req.FormValue("route"), req.FormValue("enabled") == "true") {
+				http.Error(res, "404 - Unknown Mock", http.StatusNotFound)
+				return
+			}
+			http.Redirect(res, req, "../__pack", http.StatusSeeOther)
+		case diagnosticsPath + "/network":
+			// Replaces the network rules, given in the command line syntax:
+			// POST latency=/api/*=300ms&throttle=slow-3g&fail=503@0.1
+			if req.Method != "POST" {
+				http.Error(res, "405 - Method Not Allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			noteRequest(req, "diagnostics", 0)
+			req.ParseForm()
+			networkRules := []NetworkRule{}
+			for _, kind := range []string{"latency", "throttle", "fail"} {
+				for _, value := range req.PostForm[kind] {
+					for _, spec := range strings.Fields(value) {
+						rule, err := ParseNetworkRule(kind, spec)
+						if err != nil {
+							http.Error(res, err.Error(), http.StatusBadRequest)
+							return
+						}
+						networkRules = append(networkRules, rule)
+					}
+				}
+			}
+			d.network.set(networkRules)
+			http.Redirect(res, req, "../__pack", http.StatusSeeOther)
+		default:
+			handler.ServeHTTP(res, req)
+		}
+	})
+}
+
+var diagnosticsPage = template.Must(template.New("diagnostics").Funcs(template.FuncMap{
+	"json": func(v interface{}) string {
+		data, _ := json.MarshalIndent(v, "", "  ")
+		return string(data)
+	},
+	"sorted": func(m map[string][]string) []string {
+		keys := make([]string, 0, len(m))
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		return keys
+	},
+	"clock": func(t time.Time) string { return t.Format("15:04:05") },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>pack diagnostics</title>
+<style>
+  body { font: 14px/1.5 system-ui, sans-serif; margin: 2em; color: #222; }
+  h2 { margin-top: 2em; border-bottom: 1px solid #ddd; }
+  pre, code { font: 13px ui-monospace, monospace; }
+  pre { background: #f6f6f6; padding: 1em; overflow: auto; }
+  table { border-collapse: collapse; width: 100%; }
+  td, th { text-align: left; padding: .25em .5em; border-bottom: 1px solid #eee; vertical-align: top; }
+  .error { color: #c00; white-space: pre-wrap; }
+  .warning { color: #a60; white-space: pre-wrap; }
+</style>
+</head>
+<body>
+<h1>pack diagnostics</h1>
+<p>Server started at {{clock .Started}}. <a href="__pack/state.json">JSON</a></p>
+
+<h2>Config</h2>
+<pre>{{json .Config}}</pre>
+
+<h2>Errors</h2>
+{{if not .Errors}}<p>No errors.</p>{{end}}
+<table>
+{{range .Errors}}<tr><td>{{clock .Time}}</td><td><code>{{.Path}}</code></td><td>{{range .Errors}}<div class="error">{{.}}</div>{{end}}</td></tr>
+{{end}}</table>
+
+{{with .Check}}<h2>Type errors</h2>
+{{if not .Errors}}<p>No type errors.</p>{{end}}
+{{range .Errors}}<div class="error">{{with .Location}}<code>{{.File}}:{{.Line}}:{{.Column}}</code> {{end}}{{.Text}}</div>
+{{end}}{{range .Warnings}}<div class="warning">{{with .Location}}<code>{{.File}}:{{.Line}}:{{.Column}}</code> {{end}}{{.Text}}</div>
+{{end}}
+{{end}}<h2>Recent builds</h2>
+{{if not .Builds}}<p>Nothing was built yet.</p>{{end}}
+<table>
+{{range .Builds}}<tr>
+  <td>{{clock .Time}}</td>
+  <td>{{range .Entries}}<code>{{.}}</code><br>{{end}}</td>
+  <td>{{printf "%.1f" .DurationMs}}ms</td>
+  <td>{{range $path, $size := .Outputs}}<code>{{$path}}</code> {{$size}} B<br>{{end}}
+    {{range .Errors}}<div class="error">{{.}}</div>{{end}}
+    {{range .Warnings}}<div class="warning">{{.}}</div>{{end}}</td>
+</tr>
+{{end}}</table>
+
+<h2>Mocks</h2>
+{{if not .Mocks}}<p>No mocks.</p>{{end}}
+<table>
+{{range .Mocks}}<tr>
+  <td><code>{{.Method}} {{.Path}}</code></td>
+  <td>{{.Status}}</td>
+  <td><code>{{.ID}}</code></td>
+  <td><form method="post" action="__pack/mocks">
+    <input type="hidden" name="route" value="{{.ID}}">
+    <input type="hidden" name="enabled" value="{{if .Enabled}}false{{else}}true{{end}}">
+    <button>{{if .Enabled}}Disable{{else}}Enable{{end}}</button>
+  </form></td>
+</tr>
+{{end}}</table>
+
+<h2>Network</h2>
+{{if not .Network}}<p>No network conditions are simulated.</p>{{end}}
+<table>
+{{range .Network}}<tr>
+  <td><code>{{or .Path "/*"}}</code></td>
+  <td>{{if .Latency}}+{{.Latency}}{{end}}</td>
+  <td>{{if .Bandwidth}}{{.Bandwidth}} B/s{{end}}</td>
+  <td>{{if .FailureRate}}{{if .FailureStatus}}{{.FailureStatus}}{{else}}drop{{end}} @ {{.FailureRate}}{{end}}</td>
+</tr>
+{{end}}</table>
+<form method="post" action="__pack/network">
+  <p>One rule per line, as <code>[pattern=]value</code>. Submitting replaces the rules above.</p>
+  <label>Latency, e.g. <code>/api/*=300ms</code><br><textarea name="latency" rows="2" cols="40"></textarea></label><br>
+  <label>Throttle, e.g. <code>50kB/s</code> or <code>slow-3g</code><br><textarea name="throttle" rows="2" cols="40"></textarea></label><br>
+  <label>Failures, e.g. <code>/api/*=503@0.1</code> or <code>drop@0.05</code><br><textarea name="fail" rows="2" cols="40"></textarea></label><br>
+  <button>Apply</button>
+</form>
+
+<h2>Module graph</h2>
+{{if not .Modules}}<p>Nothing was built yet.</p>{{end}}
+<table>
+{{$modules := .Modules}}{{range sorted .Modules}}<tr><td><code>{{.}}</code></td><td>{{range index $modules .}}<code>{{.}}</code><br>{{end}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
@@ -0,0 +1,97 @@
+package api
+
+import (
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+)
+
+// withFallback answers requests for pages that don't exist. Paths that look
+// like pages (no file extension) are served the fallback page configured for
+// their longest matching prefix, so that client-side routes survive a reload.
+// Everything else gets the site's 404.html, if it has one.
+//
+// exists reports whether a url path, relative to the site root, maps to a
+// file or directory.
+func withFallback(handler http.Handler, fallback map[string]string, exists func(string) bool) http.Handler {
+	prefixes := make([]string, 0, len(fallback))
+	for prefix := range fallback {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Slice(prefixes, func(i, j int) bool { return len(prefixes[i]) > len(prefixes[j]) })
+
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		query := path.Clean("/" + req.URL.Path)
+		if (req.Method != "GET" && req.Method != "HEAD") || exists(query) {
+			handler.ServeHTTP(res, req)
+			return
+		}
+		if path.Ext(query) == "" {
+			for _, prefix := range prefixes {
+				if hasPathPrefix(query, prefix) {
+					noteRequest(req, "fallback "+fallback[prefix], 0)
+					handler.ServeHTTP(res, rewriteRequest(req, fallback[prefix]))
+					return
+				}
+			}
+		}
+		if exists("/404.html") {
+			noteRequest(req, "404.html", 0)
+			handler.ServeHTTP(&statusWriter{ResponseWriter: res, status: http.StatusNotFound}, rewriteRequest(req, "/404.html"))
+			return
+		}
+		handler.ServeHTTP(res, req)
+	})
+}
+
+// hasPathPrefix reports whether the url path p is prefix or below it. Whole
+// segments are compared, so "/admin" doesn't match "/administrator".
+func hasPathPrefix(p string, prefix string) bool {
+	prefix = "/" + strings.Trim(prefix, "/")
+	return prefix == "/" || p == prefix || strings.HasPrefix(p, prefix+"/")
+}
+
+// rewriteRequest returns a copy of req for the page at p. Pages named
+// index.html are requested by their directory, since http.FileServer
+// redirects requests for them.
+func rewriteRequest(req *http.Request, p string) *http.Request {
+	p = "/" + strings.TrimPrefix(p, "/")
+	if path.Base(p) == "index.html" {
+		p = strings.TrimSuffix(p, "index.html")
+	}
+	r := req.Clone(req.Context())
+	r.URL.Path = p
+	r.URL.RawPath = ""
+	// The fallback page must be sent in full, regardless of what the client
+	// has cached for the original url.
+	r.Header.Del("If-Modified-Since")
+	r.Header.Del("If-None-Match")
+	r.Header.Del("Range")
+	return r
+}
+
+// statusWriter replaces the status code of a successful response.
+type statusWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	if code == http.StatusOK {
+		code = w.status
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
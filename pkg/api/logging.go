@@ -0,0 +1,190 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// requestNote is filled in by handlers with how a request was answered, for
+// the access log.
+type requestNote struct {
+	// Handler names what served the request, e.g. "source", "static" or
+	// "bundle".
+	Handler string
+	// BuildTime is the time spent building the response, if it was built.
+	BuildTime time.Duration
+}
+
+type requestNoteKey struct{}
+
+// noteRequest records how a request was answered. Handlers that pass the
+// request on, such as fallbacks, add to the notes of the ones they wrap:
+// "fallback /index.html > static".
+func noteRequest(req *http.Request, handler string, buildTime time.Duration) {
+	if note, ok := req.Context().Value(requestNoteKey{}).(*requestNote); ok {
+		if note.Handler != "" {
+			note.Handler += " > "
+		}
+		note.Handler += handler
+		note.BuildTime += buildTime
+	}
+}
+
+// accessLogEntry is a line of the access log.
+type accessLogEntry struct {
+	Time      time.Time `json:"time"`
+	Remote    string    `json:"remote"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Proto     string    `json:"proto"`
+	Status    int       `json:"status"`
+	Size      int64     `json:"size"`
+	Duration  float64   `json:"durationMs"`
+	Handler   string    `json:"handler,omitempty"`
+	BuildTime float64   `json:"buildTimeMs,omitempty"`
+	Referer   string    `json:"referer,omitempty"`
+	UserAgent string    `json:"userAgent,omitempty"`
+}
+
+// logFormats are the supported values of ServeOptions.LogFormat.
+var logFormats = map[string]func(accessLogEntry) string{
+	"text": func(e accessLogEntry) string {
+		line := fmt.Sprintf("%s %s %s %d %s %s", e.Time.Format("15:04:05"), e.Method, e.Path, e.Status, formatBytes(e.Size), formatMs(e.Duration))
+		if e.Handler != "" {
+			line += " " + e.Handler
+		}
+		if e.BuildTime > 0 {
+			line += " (built in " + formatMs(e.BuildTime) + ")"
+		}
+		return line
+	},
+	"json": func(e accessLogEntry) string {
+		data, _ := json.Marshal(e)
+		return string(data)
+	},
+	// The Apache/nginx combined log format.
+	"combined": func(e accessLogEntry) string {
+		orDash := func(s string) string {
+			if s == "" {
+				return "-"
+			}
+			return s
+		}
+		return fmt.Sprintf("%s - - [%s] %q %d %d %q %q", e.Remote, e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+			e.Method+" "+e.Path+" "+e.Proto, e.Status, e.Size, orDash(e.Referer), orDash(e.UserAgent))
+	},
+}
+
+func validateLogFormat(format string) error {
+	if _, ok := logFormats[format]; format != "" && !ok {
+		return fmt.Errorf("unknown log format %q, expected text, json or combined", format)
+	}
+	return nil
+}
+
+// withLogging writes a line to out for every request handled by handler,
+// in the given format. An empty format disables logging.
+func withLogging(handler http.Handler, format string, out io.Writer) http.Handler {
+	formatEntry, ok := logFormats[format]
+	if !ok {
+		return handler
+	}
+	var mu sync.Mutex
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		note := &requestNote{}
+		req = req.WithContext(context.WithValue(req.Context(), requestNoteKey{}, note))
+		w := &loggingWriter{ResponseWriter: res}
+		defer func() {
+			// Aborted responses are logged too, then the panic is passed on
+			// to the server.
+			aborted := recover()
+			if aborted != nil {
+				note.Handler += " (aborted)"
+			} else if w.status == 0 {
+				w.status = http.StatusOK
+			}
+
+			remote, _, err := net.SplitHostPort(req.RemoteAddr)
+			if err != nil {
+				remote = req.RemoteAddr
+			}
+			line := formatEntry(accessLogEntry{
+				Time:      start,
+				Remote:    remote,
+				Method:    req.Method,
+				Path:      req.URL.RequestURI(),
+				Proto:     req.Proto,
+				Status:    w.status,
+				Size:      w.size,
+				Duration:  float64(time.Since(start).Microseconds()) / 1000,
+				Handler:   note.Handler,
+				BuildTime: float64(note.BuildTime.Microseconds()) / 1000,
+				Referer:   req.Referer(),
+				UserAgent: req.UserAgent(),
+			})
+			mu.Lock()
+			fmt.Fprintln(out, line)
+			mu.Unlock()
+
+			if aborted != nil {
+				panic(aborted)
+			}
+		}()
+		handler.ServeHTTP(w, req)
+	})
+}
+
+// loggingWriter records the status and size of a response.
+type loggingWriter struct {
+	http.ResponseWriter
+	status int
+	size   int64
+}
+
+func (w *loggingWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *loggingWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.size += int64(n)
+	return n, err
+}
+
+// Flush lets streamed responses, such as proxied ones, through.
+func (w *loggingWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1024*1024:
+		return fmt.Sprintf("%.1fMB", float64(n)/1024/1024)
+	case n >= 1024:
+		return fmt.Sprintf("%.1fkB", float64(n)/1024)
+	default:
+		return fmt.Sprintf("%dB", n)
+	}
+}
+
+func formatMs(ms float64) string {
+	if ms < 10 {
+		return fmt.Sprintf("%.1fms", ms)
+	}
+	return fmt.Sprintf("%.0fms", ms)
+}
@@ -0,0 +1,148 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/davezuko/pack/internal/mocks"
+)
+
+// mockSet holds the mocks of the development server. They are loaded again
+// whenever a file in dir changes, which is checked at most once every
+// mockCheckInterval. Routes can be toggled at runtime from the diagnostics
+// page, which survives reloads.
+type mockSet struct {
+	dir string
+
+	mu      sync.Mutex
+	checked time.Time
+	stamp   string
+	routes  []mocks.Route
+	toggled map[string]bool
+}
+
+// mockCheckInterval is how often the mocks directory is checked for changes.
+// Pages make many requests at once, and each would walk it otherwise.
+const mockCheckInterval = 500 * time.Millisecond
+
+func newMockSet(dir string) *mockSet {
+	return &mockSet{dir: dir, toggled: map[string]bool{}}
+}
+
+func (m *mockSet) load() []mocks.Route {
+	if m.dir == "" {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if time.Since(m.checked) >= mockCheckInterval {
+		m.checked = time.Now()
+		m.reload()
+	}
+
+	routes := make([]mocks.Route, len(m.routes))
+	for i, r := range m.routes {
+		if enabled, ok := m.toggled[r.ID()]; ok {
+			r.Enabled = enabled
+		}
+		routes[i] = r
+	}
+	return routes
+}
+
+// reload loads the mocks again if a file in dir changed. m.mu must be held.
+func (m *mockSet) reload() {
+	var stamp strings.Builder
+	filepath.Walk(m.dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			fmt.Fprintf(&stamp, "%s@%s\n", path, info.ModTime().Format(time.RFC3339Nano))
+		}
+		return nil
+	})
+	if stamp.String() == m.stamp {
+		return
+	}
+	m.stamp = stamp.String()
+	routes, errors := mocks.Load(m.dir)
+	for _, err := range errors {
+		fmt.Fprintf(os.Stderr, "warning: %s (mock ignored)\n", err)
+	}
+	m.routes = routes
+}
+
+// toggle enables or disables the route with the given id.
+func (m *mockSet) toggle(id string, enabled bool) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, r := range m.routes {
+		if r.ID() == id {
+			m.toggled[id] = enabled
+			return true
+		}
+	}
+	return false
+}
+
+// withMocks answers requests that match an enabled mock, and passes other
+// requests on to handler.
+func withMocks(handler http.Handler, m *mockSet) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		for _, r := range m.load() {
+			if r.Enabled && r.Match(req) {
+				noteRequest(req, "mock "+r.ID(), 0)
+				serveMock(res, req, r)
+				return
+			}
+		}
+		handler.ServeHTTP(res, req)
+	})
+}
+
+func serveMock(res http.ResponseWriter, req *http.Request, r mocks.Route) {
+	if r.Delay > 0 {
+		select {
+		case <-time.After(r.Delay):
+		case <-req.Context().Done():
+			return
+		}
+	}
+
+	body := []byte(r.Body)
+	contentType := "application/json"
+	if r.BodyFile != "" {
+		data, err := ioutil.ReadFile(r.BodyFile)
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		body = data
+		contentType = ""
+	} else if len(body) > 0 && body[0] == '"' {
+		var text string
+		if json.Unmarshal(body, &text) == nil {
+			body = []byte(text)
+			contentType = "text/plain; charset=utf-8"
+		}
+	}
+
+	header := res.Header()
+	if contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+	header.Set("Cache-Control", "no-store")
+	for name, value := range r.Headers {
+		header.Set(name, value)
+	}
+	res.WriteHeader(r.Status)
+	if req.Method != "HEAD" {
+		res.Write(body)
+	}
+}
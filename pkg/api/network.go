@@ -0,0 +1,238 @@
+package api
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/davezuko/pack/internal/rules"
+)
+
+// NetworkRule simulates a slow or unreliable network for the requests that
+// match Path. Every matching rule applies: latencies add up, the lowest
+// bandwidth wins and each failure rate is rolled separately.
+type NetworkRule struct {
+	// Path is a url path pattern, as in _redirects rules, matched against
+	// the full url path, including the public path. Empty matches every
+	// request.
+	Path string `json:"path"`
+	// Latency is added before responding.
+	Latency time.Duration `json:"latency"`
+	// Bandwidth limits responses to that many bytes per second. Zero is
+	// unlimited.
+	Bandwidth int `json:"bandwidth"`
+	// FailureRate is the probability, between 0 and 1, that a request fails
+	// with FailureStatus, or has its connection dropped if FailureStatus is
+	// zero.
+	FailureRate   float64 `json:"failureRate"`
+	FailureStatus int     `json:"failureStatus"`
+}
+
+// networkPresets are the throttling profiles of browser devtools.
+var networkPresets = map[string]NetworkRule{
+	"slow-3g": {Latency: 2000 * time.Millisecond, Bandwidth: 50 * 1024},
+	"fast-3g": {Latency: 560 * time.Millisecond, Bandwidth: 180 * 1024},
+}
+
+// ParseNetworkRule parses a network rule from the command line syntax
+// "[pattern=]value", where the value depends on kind:
+//
+//	latency   a duration, e.g. "300ms"
+//	throttle  a rate such as "50kB/s", or a preset: "slow-3g", "fast-3g"
+//	fail      "status@rate" or "drop@rate", e.g. "503@0.1"
+func ParseNetworkRule(kind string, spec string) (NetworkRule, error) {
+	rule := NetworkRule{}
+	value := spec
+	if i := strings.LastIndex(spec, "="); i >= 0 {
+		rule.Path, value = spec[:i], spec[i+1:]
+		if !strings.HasPrefix(rule.Path, "/") {
+			return rule, fmt.Errorf("invalid %s rule %q: the path must start with \"/\"", kind, spec)
+		}
+	}
+
+	switch kind {
+	case "latency":
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 {
+			return rule, fmt.Errorf("invalid latency %q, expected a duration such as 300ms", value)
+		}
+		rule.Latency = d
+	case "throttle":
+		if preset, ok := networkPresets[value]; ok {
+			rule.Latency, rule.Bandwidth = preset.Latency, preset.Bandwidth
+			break
+		}
+		bandwidth, err := parseRate(value)
+		if err != nil {
+			return rule, err
+		}
+		rule.Bandwidth = bandwidth
+	case "fail":
+		i := strings.Index(value, "@")
+		if i < 0 {
+			return rule, fmt.Errorf("invalid failure %q, expected status@rate or drop@rate", value)
+		}
+		if value[:i] != "drop" {
+			status, err := strconv.Atoi(value[:i])
+			if err != nil || http.StatusText(status) == "" {
+				return rule, fmt.Errorf("invalid failure status %q", value[:i])
+			}
+			rule.FailureStatus = status
+		}
+		rate, err := strconv.ParseFloat(value[i+1:], 64)
+		if err != nil || rate < 0 || rate > 1 {
+			return rule, fmt.Errorf("invalid failure rate %q, expected a number between 0 and 1", value[i+1:])
+		}
+		rule.FailureRate = rate
+	default:
+		return rule, fmt.Errorf("unknown network rule %q", kind)
+	}
+	return rule, nil
+}
+
+// parseRate parses a rate in bytes per second, such as "500B/s", "50kB/s"
+// or "1MB/s".
+func parseRate(s string) (int, error) {
+	units := []struct {
+		suffix string
+		scale  float64
+	}{{"MB/s", 1024 * 1024}, {"kB/s", 1024}, {"KB/s", 1024}, {"B/s", 1}}
+	for _, u := range units {
+		if strings.HasSuffix(s, u.suffix) {
+			n, err := strconv.ParseFloat(strings.TrimSuffix(s, u.suffix), 64)
+			if err == nil && n*u.scale >= 1 {
+				return int(n * u.scale), nil
+			}
+			break
+		}
+	}
+	return 0, fmt.Errorf("invalid rate %q, expected a rate such as 50kB/s or a preset (slow-3g, fast-3g)", s)
+}
+
+// networkSim applies network rules to the requests of the development
+// server. Rules can be replaced at runtime from the diagnostics page.
+type networkSim struct {
+	mu       sync.Mutex
+	rules    []NetworkRule
+	patterns []rules.Pattern
+	rand     *rand.Rand
+}
+
+func newNetworkSim(networkRules []NetworkRule) *networkSim {
+	sim := &networkSim{rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+	sim.set(networkRules)
+	return sim
+}
+
+func (sim *networkSim) set(networkRules []NetworkRule) {
+	sim.mu.Lock()
+	defer sim.mu.Unlock()
+	sim.rules = append([]NetworkRule{}, networkRules...)
+	sim.patterns = make([]rules.Pattern, len(networkRules))
+	for i, r := range networkRules {
+		path := r.Path
+		if path == "" {
+			path = "/*"
+		}
+		sim.patterns[i] = rules.NewPattern(path)
+	}
+}
+
+func (sim *networkSim) get() []NetworkRule {
+	sim.mu.Lock()
+	defer sim.mu.Unlock()
+	return append([]NetworkRule{}, sim.rules...)
+}
+
+// plan returns the conditions to simulate for a request, and the failure it
+// should get, if any: a status code, or -1 to drop the connection.
+func (sim *networkSim) plan(path string) (latency time.Duration, bandwidth int, failure int) {
+	sim.mu.Lock()
+	defer sim.mu.Unlock()
+	for i, r := range sim.rules {
+		if _, ok := sim.patterns[i].Match(path); !ok {
+			continue
+		}
+		latency += r.Latency
+		if r.Bandwidth > 0 && (bandwidth == 0 || r.Bandwidth < bandwidth) {
+			bandwidth = r.Bandwidth
+		}
+		if failure == 0 && r.FailureRate > 0 && sim.rand.Float64() < r.FailureRate {
+			failure = r.FailureStatus
+			if failure == 0 {
+				failure = -1
+			}
+		}
+	}
+	return latency, bandwidth, failure
+}
+
+// withNetwork simulates the network conditions configured for each request.
+func withNetwork(handler http.Handler, sim *networkSim) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		latency, bandwidth, failure := sim.plan(req.URL.Path)
+		if latency > 0 {
+			select {
+			case <-time.After(latency):
+			case <-req.Context().Done():
+				return
+			}
+		}
+		switch {
+		case failure < 0:
+			noteRequest(req, "dropped", 0)
+			// Aborts the response without logging a stack trace.
+			panic(http.ErrAbortHandler)
+		case failure > 0:
+			noteRequest(req, "injected failure", 0)
+			http.Error(res, fmt.Sprintf("%d - %s (injected by pack)", failure, http.StatusText(failure)), failure)
+			return
+		}
+		if bandwidth > 0 {
+			res = &throttledWriter{ResponseWriter: res, req: req, bandwidth: bandwidth}
+		}
+		handler.ServeHTTP(res, req)
+	})
+}
+
+// throttledWriter writes a response no faster than bandwidth bytes per
+// second.
+type throttledWriter struct {
+	http.ResponseWriter
+	req       *http.Request
+	bandwidth int
+}
+
+func (w *throttledWriter) Write(b []byte) (int, error) {
+	// Write in slices of a tenth of a second, so progress is visible.
+	chunk := w.bandwidth / 10
+	if chunk < 1 {
+		chunk = 1
+	}
+	written := 0
+	for len(b) > 0 {
+		n := chunk
+		if n > len(b) {
+			n = len(b)
+		}
+		m, err := w.ResponseWriter.Write(b[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		if f, ok := w.ResponseWriter.(http.Flusher); ok {
+			f.Flush()
+		}
+		select {
+		case <-time.After(time.Duration(n) * time.Second / time.Duration(w.bandwidth)):
+		case <-w.req.Context().Done():
+			return written, w.req.Context().Err()
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
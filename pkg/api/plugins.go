@@ -0,0 +1,226 @@
+package api
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+
+	"github.com/PuerkitoBio/goquery"
+	esbuild "github.com/evanw/esbuild/pkg/api"
+)
+
+// Plugin extends the build pipeline of Build and Start. Setup registers the
+// plugin's hooks. It's called once per Build, and once when Start starts the
+// development server, whose hooks then run for every page and script it
+// builds.
+//
+// Hooks run in the order plugins are given in, and may be called
+// concurrently for different files. Errors returned by hooks fail the build,
+// or the request in the development server.
+type Plugin struct {
+	Name  string
+	Setup func(PluginBuild)
+}
+
+// PluginBuild registers the hooks of a plugin.
+type PluginBuild struct {
+	// Mode is "production" for Build and "development" for Start.
+	Mode string
+
+	// OnResolve and OnLoad register esbuild hooks, which run for every
+	// import of the scripts and stylesheets that are bundled. See
+	// github.com/evanw/esbuild/pkg/api for their options and results.
+	OnResolve func(options OnResolveOptions, callback func(OnResolveArgs) (OnResolveResult, error))
+	OnLoad    func(options OnLoadOptions, callback func(OnLoadArgs) (OnLoadResult, error))
+
+	// OnHTML registers a transform of html pages. It's called with the parsed
+	// page before anything in it is bundled, so scripts and stylesheets it
+	// adds are bundled too.
+	OnHTML func(callback func(HTMLArgs) error)
+
+	// OnStart registers a hook that runs before every build.
+	OnStart func(callback func() error)
+	// OnEnd registers a hook that runs after every build. It may add errors
+	// and warnings to the result.
+	OnEnd func(callback func(*BuildResult) error)
+	// OnOutputFile registers a hook that runs for every page, bundle and
+	// asset before it's written or served, and may change its contents.
+	// Files that are copied as-is, such as the static directory, aren't
+	// passed to it.
+	OnOutputFile func(callback func(*PluginOutputFile) error)
+
+	// OnDispose registers a hook that runs when the plugin is no longer
+	// used: at the end of Build, or when the development server stops.
+	OnDispose func(callback func())
+}
+
+// The options and results of esbuild's resolve and load hooks.
+type (
+	OnResolveOptions = esbuild.OnResolveOptions
+	OnResolveArgs    = esbuild.OnResolveArgs
+	OnResolveResult  = esbuild.OnResolveResult
+	OnLoadOptions    = esbuild.OnLoadOptions
+	OnLoadArgs       = esbuild.OnLoadArgs
+	OnLoadResult     = esbuild.OnLoadResult
+)
+
+// HTMLArgs is an html page being built.
+type HTMLArgs struct {
+	// Path is the page's source file.
+	Path string
+	Doc  *goquery.Document
+}
+
+// PluginOutputFile is a file that is about to be written or served.
+type PluginOutputFile struct {
+	// Path is relative to the output directory, e.g. "about/index.html".
+	Path     string
+	Contents []byte
+}
+
+// pluginHooks are the hooks registered by a set of plugins. Errors returned
+// by the hooks are prefixed with the name of their plugin.
+type pluginHooks struct {
+	esbuild []esbuild.Plugin
+	html    []func(HTMLArgs) error
+	start   []func() error
+	end     []func(*BuildResult) error
+	output  []func(*PluginOutputFile) error
+	dispose []func()
+
+	disposed sync.Once
+}
+
+type resolveHook struct {
+	options  OnResolveOptions
+	callback func(OnResolveArgs) (OnResolveResult, error)
+}
+
+type loadHook struct {
+	options  OnLoadOptions
+	callback func(OnLoadArgs) (OnLoadResult, error)
+}
+
+// setupPlugins calls the Setup of every plugin and collects their hooks. The
+// esbuild hooks are wrapped in an esbuild plugin for each of them, which
+// registers them again on every esbuild build.
+func setupPlugins(plugins []Plugin, mode string) *pluginHooks {
+	hooks := &pluginHooks{}
+	for _, p := range plugins {
+		if p.Setup == nil {
+			continue
+		}
+		name := p.Name
+		resolves := []resolveHook{}
+		loads := []loadHook{}
+		p.Setup(PluginBuild{
+			Mode: mode,
+			OnResolve: func(options OnResolveOptions, callback func(OnResolveArgs) (OnResolveResult, error)) {
+				resolves = append(resolves, resolveHook{options, callback})
+			},
+			OnLoad: func(options OnLoadOptions, callback func(OnLoadArgs) (OnLoadResult, error)) {
+				loads = append(loads, loadHook{options, callback})
+			},
+			OnHTML: func(callback func(HTMLArgs) error) {
+				hooks.html = append(hooks.html, func(args HTMLArgs) error {
+					return pluginError(name, callback(args))
+				})
+			},
+			OnStart: func(callback func() error) {
+				hooks.start = append(hooks.start, func() error {
+					return pluginError(name, callback())
+				})
+			},
+			OnEnd: func(callback func(*BuildResult) error) {
+				hooks.end = append(hooks.end, func(result *BuildResult) error {
+					return pluginError(name, callback(result))
+				})
+			},
+			OnOutputFile: func(callback func(*PluginOutputFile) error) {
+				hooks.output = append(hooks.output, func(f *PluginOutputFile) error {
+					return pluginError(name, callback(f))
+				})
+			},
+			OnDispose: func(callback func()) {
+				hooks.dispose = append(hooks.dispose, callback)
+			},
+		})
+		if len(resolves) == 0 && len(loads) == 0 {
+			continue
+		}
+		hooks.esbuild = append(hooks.esbuild, esbuild.Plugin{
+			Name: name,
+			Setup: func(build esbuild.PluginBuild) {
+				for _, h := range resolves {
+					build.OnResolve(h.options, h.callback)
+				}
+				for _, h := range loads {
+					build.OnLoad(h.options, h.callback)
+				}
+			},
+		})
+	}
+	return hooks
+}
+
+func pluginError(plugin string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return fmt.Errorf("plugin %q: %w", plugin, err)
+}
+
+// startBuild runs the OnStart hooks.
+func (hooks *pluginHooks) startBuild() []Message {
+	errors := []Message{}
+	for _, hook := range hooks.start {
+		if err := hook(); err != nil {
+			errors = append(errors, Message{Text: err.Error()})
+		}
+	}
+	return errors
+}
+
+// endBuild runs the OnEnd hooks.
+func (hooks *pluginHooks) endBuild(result *BuildResult) {
+	for _, hook := range hooks.end {
+		if err := hook(result); err != nil {
+			result.Errors = append(result.Errors, Message{Text: err.Error()})
+		}
+	}
+}
+
+// disposeAll runs the OnDispose hooks. Only the first call runs them, and
+// the others wait for it.
+func (hooks *pluginHooks) disposeAll() {
+	hooks.disposed.Do(func() {
+		for _, hook := range hooks.dispose {
+			hook()
+		}
+	})
+}
+
+// transformHTML runs the OnHTML hooks. It's the OnDocument option of
+// bundler.BundleHTML for the page at path.
+func (hooks *pluginHooks) transformHTML(path string) func(*goquery.Document) error {
+	return func(doc *goquery.Document) error {
+		for _, hook := range hooks.html {
+			if err := hook(HTMLArgs{Path: path, Doc: doc}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// outputFile runs the OnOutputFile hooks, and returns the new contents of
+// the file.
+func (hooks *pluginHooks) outputFile(path string, contents []byte) ([]byte, error) {
+	f := &PluginOutputFile{Path: filepath.ToSlash(path), Contents: contents}
+	for _, hook := range hooks.output {
+		if err := hook(f); err != nil {
+			return nil, err
+		}
+	}
+	return f.Contents, nil
+}
@@ -0,0 +1,222 @@
+package api
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/davezuko/pack/internal/fs"
+	"github.com/davezuko/pack/internal/logger"
+	"github.com/davezuko/pack/internal/rules"
+)
+
+// siteRules holds the _headers and _redirects files of a site. They are
+// looked up in each of dirs in turn and parsed again whenever they change.
+type siteRules struct {
+	dirs []string
+
+	mu        sync.Mutex
+	stamps    map[string]string
+	headers   []rules.Header
+	redirects []rules.Redirect
+}
+
+func newSiteRules(dirs ...string) *siteRules {
+	return &siteRules{dirs: dirs, stamps: map[string]string{}}
+}
+
+func (s *siteRules) load() ([]rules.Header, []rules.Redirect) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if data, file, ok := s.read("_headers"); ok {
+		headers, errors := rules.ParseHeaders(file, data)
+		printRuleErrors(errors)
+		s.headers = headers
+	}
+	if data, file, ok := s.read("_redirects"); ok {
+		redirects, errors := rules.ParseRedirects(file, data)
+		printRuleErrors(errors)
+		s.redirects = redirects
+	}
+	return s.headers, s.redirects
+}
+
+// read returns the contents of the named file if it changed since the last
+// call, or was removed (in which case data is nil).
+func (s *siteRules) read(name string) ([]byte, string, bool) {
+	file, stamp := "", ""
+	for _, dir := range s.dirs {
+		p := filepath.Join(dir, name)
+		if info, err := os.Stat(p); err == nil && info.Mode().IsRegular() {
+			file = p
+			stamp = p + "@" + info.ModTime().Format(time.RFC3339Nano)
+			break
+		}
+	}
+	if stamp == s.stamps[name] {
+		return nil, file, false
+	}
+	s.stamps[name] = stamp
+	if file == "" {
+		return nil, file, true
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "warning: failed to read %s: %s\n", file, err)
+	}
+	return data, file, true
+}
+
+func printRuleErrors(errors []rules.Error) {
+	for _, err := range errors {
+		fmt.Fprintf(os.Stderr, "warning: %s (rule ignored)\n", err)
+	}
+}
+
+// withRules applies the site's _headers and _redirects files the way a
+// static host would. Redirect rules are evaluated in order and the first
+// match wins. Unless forced with "!", a rule doesn't apply when a file exists
+// at the requested path. Rules with conditions (Country, Language, Role...)
+// can't be evaluated locally and are skipped.
+//
+// Paths in rules are relative to the site, which is mounted at base.
+func withRules(handler http.Handler, site *siteRules, base string, exists func(string) bool) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		headers, redirects := site.load()
+
+		custom := http.Header{}
+		for _, h := range headers {
+			if h.Match(req.URL.Path) {
+				for name, values := range h.Headers {
+					custom[name] = append(custom[name], values...)
+				}
+			}
+		}
+		if len(custom) > 0 {
+			res = &headerWriter{ResponseWriter: res, headers: custom}
+		}
+
+		query := path.Clean("/" + req.URL.Path)
+		for _, r := range redirects {
+			if len(r.Conditions) > 0 || (!r.Force && exists(query)) {
+				continue
+			}
+			to, ok := r.Match(req.URL)
+			if !ok {
+				continue
+			}
+			noteRequest(req, fmt.Sprintf("_redirects:%d", r.Line), 0)
+			switch {
+			case r.Proxy():
+				proxyTo(to).ServeHTTP(res, req)
+			case r.Status >= 300 && r.Status < 400:
+				if !rules.IsExternal(to) {
+					to = base + strings.TrimPrefix(to, "/")
+				}
+				http.Redirect(res, req, to, r.Status)
+			default:
+				target, err := url.Parse(to)
+				if err != nil {
+					http.Error(res, "500 - Internal Server Error", http.StatusInternalServerError)
+					return
+				}
+				rewritten := rewriteRequest(req, target.Path)
+				rewritten.URL.RawQuery = target.RawQuery
+				if r.Status != http.StatusOK {
+					res = &statusWriter{ResponseWriter: res, status: r.Status}
+				}
+				handler.ServeHTTP(res, rewritten)
+			}
+			return
+		}
+		handler.ServeHTTP(res, req)
+	})
+}
+
+// proxyTo forwards requests to the url to.
+func proxyTo(to string) http.Handler {
+	target, err := url.Parse(to)
+	if err != nil {
+		return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			http.Error(res, "502 - Bad Gateway", http.StatusBadGateway)
+		})
+	}
+	return &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			req.URL = target
+			req.Host = target.Host
+		},
+	}
+}
+
+// headerWriter sets custom headers on a response once it's written,
+// overriding the ones set by the handler.
+type headerWriter struct {
+	http.ResponseWriter
+	headers     http.Header
+	wroteHeader bool
+}
+
+func (w *headerWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		// Repeated headers, such as Set-Cookie, are kept apart.
+		for name, values := range w.headers {
+			w.Header().Set(name, values[0])
+			for _, v := range values[1:] {
+				w.Header().Add(name, v)
+			}
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *headerWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// checkRules validates the _headers and _redirects files of a build. Besides
+// syntax errors, rewrites to pages that aren't part of the build are
+// reported.
+func checkRules(dir string, log logger.Log) {
+	if data, err := ioutil.ReadFile(filepath.Join(dir, "_headers")); err == nil {
+		_, errors := rules.ParseHeaders(filepath.Join(dir, "_headers"), data)
+		for _, err := range errors {
+			log.AddError(err.Error())
+		}
+	}
+	file := filepath.Join(dir, "_redirects")
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return
+	}
+	redirects, errors := rules.ParseRedirects(file, data)
+	for _, err := range errors {
+		log.AddError(err.Error())
+	}
+	for _, r := range redirects {
+		if (r.Status >= 300 && r.Status < 400) || rules.IsExternal(r.To) || strings.Contains(r.To, ":") {
+			continue
+		}
+		p := r.To
+		if i := strings.IndexAny(p, "?#"); i >= 0 {
+			p = p[:i]
+		}
+		p = filepath.Join(dir, filepath.FromSlash(p))
+		if !fs.Exists(p) || (strings.HasSuffix(r.To, "/") && !fs.Exists(filepath.Join(p, "index.html"))) {
+			log.AddError(fmt.Sprintf("%s:%d: %s rewrites to %s, which is not part of the build", file, r.Line, r.From, r.To))
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package api
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/davezuko/pack/internal/compress"
+)
+
+// fingerprinted matches file names with a content hash, as emitted by
+// BuildOptions.Hash (e.g. main.1a2b3c4d.js).
+var fingerprinted = regexp.MustCompile(`\.[0-9a-f]{8}\.[^./]+$`)
+
+// minCompressSize is the size below which compressing a response on the fly
+// isn't worth it.
+const minCompressSize = 1024
+
+// staticHandler serves a production build the way a CDN would:
+//
+//   - precompressed .br and .gz siblings are served to clients that accept
+//     them, and other compressible files are compressed on the fly;
+//   - fingerprinted files are cached forever, everything else (notably html)
+//     must be revalidated;
+//   - every response has a strong ETag derived from its contents.
+//
+// Anything that isn't a regular file is left to http.FileServer.
+type staticHandler struct {
+	root       string
+	fileServer http.Handler
+
+	mu    sync.Mutex
+	cache map[string]staticEntry
+}
+
+// staticEntry is a file representation cached in memory, keyed by path and
+// encoding. It is invalidated when the file's modification time changes.
+type staticEntry struct {
+	modTime  time.Time
+	contents []byte
+	etag     string
+}
+
+func newStaticHandler(root string) *staticHandler {
+	return &staticHandler{
+		root:       root,
+		fileServer: http.FileServer(http.Dir(root)),
+		cache:      map[string]staticEntry{},
+	}
+}
+
+func (h *staticHandler) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	name := path.Clean("/" + req.URL.Path)
+	if strings.HasSuffix(req.URL.Path, "/") {
+		name = path.Join(name, "index.html")
+	}
+	file := filepath.Join(h.root, filepath.FromSlash(name))
+	info, err := os.Stat(file)
+	if err != nil || !info.Mode().IsRegular() || strings.HasSuffix(req.URL.Path, "/index.html") {
+		noteRequest(req, "static", 0)
+		h.fileServer.ServeHTTP(res, req)
+		return
+	}
+
+	header := res.Header()
+	if fingerprinted.MatchString(name) {
+		header.Set("Cache-Control", "public, max-age=31536000, immutable")
+	} else {
+		header.Set("Cache-Control", "no-cache")
+	}
+
+	var entry staticEntry
+	if compress.Compressible(name) {
+		header.Add("Vary", "Accept-Encoding")
+		if enc, ok := h.negotiate(file, info, req.Header.Get("Accept-Encoding")); ok {
+			entry, err = h.encoded(file, info, enc)
+			if err == nil {
+				header.Set("Content-Encoding", enc.Name)
+				noteRequest(req, "static "+enc.Name, 0)
+			}
+		}
+	}
+	if err != nil || entry.contents == nil {
+		entry, err = h.load(file, "", info.ModTime(), func() ([]byte, error) {
+			return ioutil.ReadFile(file)
+		})
+		noteRequest(req, "static", 0)
+		if err != nil {
+			http.Error(res, "500 - Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	header.Set("ETag", entry.etag)
+	http.ServeContent(res, req, name, entry.modTime, bytes.NewReader(entry.contents))
+}
+
+// negotiate picks the encoding to serve a file with. Precompressed siblings
+// on disk are preferred over compressing on the fly, which is skipped for
+// small files.
+func (h *staticHandler) negotiate(file string, info os.FileInfo, acceptEncoding string) (compress.Encoding, bool) {
+	accepted := compress.Accepted(acceptEncoding)
+	for _, enc := range accepted {
+		if sibling, err := os.Stat(file + enc.Ext); err == nil && sibling.Mode().IsRegular() {
+			return enc, true
+		}
+	}
+	if len(accepted) == 0 || info.Size() < minCompressSize {
+		return compress.Encoding{}, false
+	}
+	return accepted[0], true
+}
+
+// encoded returns the file compressed with enc, from its precompressed
+// sibling if there is one.
+func (h *staticHandler) encoded(file string, info os.FileInfo, enc compress.Encoding) (staticEntry, error) {
+	if sibling, err := os.Stat(file + enc.Ext); err == nil && sibling.Mode().IsRegular() {
+		return h.load(file, enc.Name, sibling.ModTime(), func() ([]byte, error) {
+			return ioutil.ReadFile(file + enc.Ext)
+		})
+	}
+	return h.load(file, enc.Name, info.ModTime(), func() ([]byte, error) {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		return enc.Compress(data)
+	})
+}
+
+func (h *staticHandler) load(file string, encoding string, modTime time.Time, read func() ([]byte, error)) (staticEntry, error) {
+	key := file + "\x00" + encoding
+	h.mu.Lock()
+	entry, ok := h.cache[key]
+	h.mu.Unlock()
+	if ok && entry.modTime.Equal(modTime) {
+		return entry, nil
+	}
+
+	contents, err := read()
+	if err != nil {
+		return staticEntry{}, err
+	}
+	sum := sha1.Sum(contents)
+	entry = staticEntry{modTime: modTime, contents: contents}
+	if encoding == "" {
+		entry.etag = fmt.Sprintf("%q", hex.EncodeToString(sum[:]))
+	} else {
+		// Strong validators must differ between representations.
+		entry.etag = fmt.Sprintf("%q", hex.EncodeToString(sum[:])+"-"+encoding)
+	}
+
+	h.mu.Lock()
+	h.cache[key] = entry
+	h.mu.Unlock()
+	return entry, nil
+}
@@ -0,0 +1,134 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/davezuko/pack/internal/coverage"
+	"github.com/davezuko/pack/internal/testrunner"
+)
+
+// watchInterval is how often files are checked for changes in watch mode.
+const watchInterval = 300 * time.Millisecond
+
+func testImpl(ctx context.Context, opts TestOptions) TestResult {
+	if !testrunner.ValidReporter(opts.Reporter) {
+		text := fmt.Sprintf("unknown reporter %q, expected one of: %s", opts.Reporter, strings.Join(testrunner.Reporters, ", "))
+		result := TestResult{Errors: []Message{{Text: text}}}
+		if opts.OnResult != nil {
+			opts.OnResult(result)
+		}
+		return result
+	}
+	result := runTests(ctx, opts)
+	if !opts.Watch {
+		return result
+	}
+
+	stamp := sourceStamp(opts.SourceDir)
+	ticker := time.NewTicker(watchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return result
+		case <-ticker.C:
+		}
+		if s := sourceStamp(opts.SourceDir); s != stamp {
+			stamp = s
+			if opts.OutputFile == "" {
+				fmt.Printf("\n> Files changed, running the tests again\n\n")
+			}
+			result = runTests(ctx, opts)
+		}
+	}
+}
+
+func runTests(ctx context.Context, opts TestOptions) TestResult {
+	result := reportTests(ctx, opts)
+	if opts.OnResult != nil {
+		opts.OnResult(result)
+	}
+	return result
+}
+
+func reportTests(ctx context.Context, opts TestOptions) TestResult {
+	r := testrunner.Run(ctx, testrunner.Options{Root: opts.SourceDir, Run: opts.Run, Coverage: opts.Coverage})
+	result := TestResult{Errors: []Message{}}
+	result.Passed, result.Failed, result.Skipped = r.Counts()
+	for _, err := range r.Errors {
+		result.Errors = append(result.Errors, Message{Text: err})
+	}
+	if len(r.Errors) > 0 {
+		return result
+	}
+
+	var out io.Writer = os.Stdout
+	if opts.OutputFile != "" {
+		f, err := os.Create(opts.OutputFile)
+		if err != nil {
+			result.Errors = append(result.Errors, Message{Text: err.Error()})
+			return result
+		}
+		defer f.Close()
+		out = f
+	}
+	if err := testrunner.Report(out, opts.Reporter, r); err != nil {
+		result.Errors = append(result.Errors, Message{Text: err.Error()})
+	}
+	if r.Coverage != nil {
+		s := r.Coverage.Summary()
+		result.Coverage = &CoverageSummary{Lines: s.Lines(), Functions: s.Functions()}
+		// The summary would make TAP and JUnit reports unreadable.
+		if opts.Reporter == "" || opts.Reporter == "pretty" {
+			fmt.Fprintln(out)
+			coverage.WriteText(out, *r.Coverage, opts.SourceDir)
+		}
+		if err := writeCoverage(opts, *r.Coverage); err != nil {
+			result.Errors = append(result.Errors, Message{Text: fmt.Sprintf("failed to write the coverage report: %s", err)})
+		}
+	}
+	return result
+}
+
+// writeCoverage writes the lcov and HTML coverage reports.
+func writeCoverage(opts TestOptions, c coverage.Coverage) error {
+	dir := opts.CoverageDir
+	if dir == "" {
+		dir = "coverage"
+	}
+	if err := coverage.WriteHTML(dir, c, opts.SourceDir); err != nil {
+		return err
+	}
+	f, err := os.Create(filepath.Join(dir, "lcov.info"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return coverage.WriteLCOV(f, c)
+}
+
+// sourceStamp changes whenever a file in dir is added, removed or modified.
+func sourceStamp(dir string) string {
+	count := 0
+	latest := time.Time{}
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info.IsDir() && info.Name() == "node_modules" {
+			return filepath.SkipDir
+		}
+		count++
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+		return nil
+	})
+	return fmt.Sprintf("%d@%s", count, latest.Format(time.RFC3339Nano))
+}
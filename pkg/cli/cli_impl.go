@@ -1,12 +1,17 @@
 package cli
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 
 	"github.com/davezuko/pack/pkg/api"
+	"github.com/davezuko/pack/templates"
 	"github.com/manifoldco/promptui"
 )
 
@@ -20,6 +25,9 @@ func runImpl(args []string) {
 	commands := []command{
 		buildCommand(),
 		newCommand(),
+		generateCommand(),
+		testCommand(),
+		checkCommand(),
 		serveCommand(),
 		startCommand(),
 	}
@@ -81,25 +89,45 @@ func buildCommand() command {
 
 	var bundle bool
 	var minify bool
+	var hash bool
+	var base string
+	var inlineLimit int
+	var compress bool
+	var compressThreshold int
 	cmd.fs.BoolVar(&bundle, "bundle", true, "")
 	cmd.fs.BoolVar(&minify, "minify", true, "")
+	cmd.fs.BoolVar(&hash, "hash", false, "add content hashes to bundle and asset file names")
+	cmd.fs.StringVar(&base, "base", "/", "public url the app is deployed under")
+	cmd.fs.IntVar(&inlineLimit, "inline-limit", 4096, "max size in bytes of inline scripts and styles kept inline")
+	cmd.fs.BoolVar(&compress, "compress", false, "write gzip and brotli compressed copies of output files")
+	cmd.fs.IntVar(&compressThreshold, "compress-threshold", 1024, "min size in bytes of files to compress")
+	var typecheck bool
+	cmd.fs.BoolVar(&typecheck, "typecheck", false, "type-check the project with tsc, failing the build on type errors")
 
 	cmd.Run = func(args []string) error {
-		opts := api.BuildOptions{
-			SourceDir: "src",
-			StaticDir: "static",
-			OutputDir: "dist",
-			Bundle:    bundle,
-			Minify:    minify,
-			Hash:      false,
-		}
-		result := api.Build(opts)
-		for _, msg := range result.Warnings {
-			fmt.Printf("[warning]: %s\n", msg.Text)
+		plugins, err := loadPlugins()
+		if err != nil {
+			return err
 		}
-		for _, msg := range result.Errors {
-			fmt.Printf("[error]: %s\n", msg.Text)
+		opts := api.BuildOptions{
+			SourceDir:   "src",
+			StaticDir:   "static",
+			OutputDir:   "dist",
+			Bundle:      bundle,
+			Minify:      minify,
+			Hash:        hash,
+			PublicPath:  base,
+			InlineLimit: inlineLimit,
+
+			Compress:          compress,
+			CompressThreshold: compressThreshold,
+			Typecheck:         typecheck,
+			Plugins:           plugins,
 		}
+		ctx, stop := interruptContext()
+		defer stop()
+		result := api.Build(ctx, opts)
+		printMessages(result.Errors, result.Warnings)
 		if len(result.Errors) > 0 {
 			if len(result.Errors) == 1 {
 				return fmt.Errorf("Build failed with 1 error.")
@@ -107,6 +135,21 @@ func buildCommand() command {
 				return fmt.Errorf("Build failed with %d errors.", len(result.Errors))
 			}
 		}
+		if compress {
+			fmt.Println()
+			for _, f := range result.OutputFiles {
+				if len(f.CompressedSizes) == 0 {
+					continue
+				}
+				fmt.Printf("  %-40s %8s", f.Path, formatSize(f.Size))
+				for _, enc := range []string{"gzip", "br"} {
+					if size, ok := f.CompressedSizes[enc]; ok {
+						fmt.Printf("  %s: %8s", enc, formatSize(size))
+					}
+				}
+				fmt.Println()
+			}
+		}
 		fmt.Printf("\nSuccessfully built your application to ./%s\n", opts.OutputDir)
 		fmt.Printf("\nRun `pack serve` to host your production build locally.\n")
 		return nil
@@ -114,15 +157,14 @@ func buildCommand() command {
 	return cmd
 }
 
-type projectTemplate struct {
-	Name string
-	Repo string
-}
-
-func templates() []projectTemplate {
-	return []projectTemplate{
-		{Name: "Web App (React)", Repo: "davezuko/pack#templates/typescript-react"},
-		{Name: "Web App (Preact)", Repo: "davezuko/pack#templates/typescript-preact"},
+func formatSize(n int64) string {
+	switch {
+	case n >= 1024*1024:
+		return fmt.Sprintf("%.1f MB", float64(n)/1024/1024)
+	case n >= 1024:
+		return fmt.Sprintf("%.1f kB", float64(n)/1024)
+	default:
+		return fmt.Sprintf("%d B", n)
 	}
 }
 
@@ -130,19 +172,38 @@ func newCommand() command {
 	cmd := _newCommand("new")
 
 	var template string
+	var packageManager string
 	var yarn bool
-	cmd.fs.StringVar(&template, "template", "", "")
-	cmd.fs.BoolVar(&yarn, "yarn", false, "install dependencies with yarn")
+	var noInstall bool
+	var gitInit bool
+	cmd.fs.StringVar(&template, "template", "", "built-in template name, directory, .tar.gz/.zip archive, or git repository (user/repo#ref:subdir)")
+	cmd.fs.StringVar(&packageManager, "package-manager", "", "install dependencies with npm, yarn or pnpm (default: detected from the template's lockfile)")
+	cmd.fs.BoolVar(&yarn, "yarn", false, "same as --package-manager=yarn")
+	cmd.fs.BoolVar(&noInstall, "no-install", false, "don't install dependencies")
+	cmd.fs.BoolVar(&gitInit, "git-init", false, "initialize a git repository with the project as its first commit")
+	vars := map[string]string{}
+	cmd.fs.Var(varsFlag(vars), "var", "set the template variable `key=value` instead of being asked for it (repeatable)")
 
 	cmd.Run = func(args []string) error {
 		if len(args) == 0 {
 			return fmt.Errorf("Missing directory name. Try `pack new <directory>`.")
 		}
+		if yarn {
+			packageManager = "yarn"
+		}
+		interactive := isTerminal(os.Stdin) && isTerminal(os.Stdout)
 		if template == "" {
-			tmpls := templates()
+			tmpls := templates.Builtin
+			if !interactive {
+				names := make([]string, len(tmpls))
+				for i := range tmpls {
+					names[i] = tmpls[i].Name
+				}
+				return fmt.Errorf("Missing template. The terminal isn't interactive, so pass one with --template=<name>.\nBuilt-in templates: %s", strings.Join(names, ", "))
+			}
 			items := make([]string, len(tmpls))
 			for i := range tmpls {
-				items[i] = tmpls[i].Name
+				items[i] = tmpls[i].Title
 			}
 			prompt := promptui.Select{
 				Label:        "Select a template for your project:",
@@ -157,15 +218,36 @@ func newCommand() command {
 			if err != nil {
 				return fmt.Errorf("Cancelled template selection.")
 			}
-			template = tmpls[i].Repo
+			template = tmpls[i].Name
 		}
 
-		err := api.New(api.NewOptions{
-			Path:     args[0],
-			Template: template,
-			Yarn:     yarn,
-		})
-		if err != nil {
+		opts := api.NewOptions{
+			Path:           args[0],
+			Template:       template,
+			PackageManager: packageManager,
+			NoInstall:      noInstall,
+			GitInit:        gitInit,
+			Vars:           vars,
+		}
+		// Template variables get their default value when nobody can be
+		// asked for them.
+		if interactive {
+			opts.Prompt = func(name string, message string, def string) (string, error) {
+				prompt := promptui.Prompt{Label: message, Default: def}
+				value, err := prompt.Run()
+				if err != nil {
+					return "", fmt.Errorf("Cancelled the template variable %q.", name)
+				}
+				return value, nil
+			}
+		}
+
+		ctx, stop := interruptContext()
+		defer stop()
+		if err := api.New(ctx, opts); err != nil {
+			if ctx.Err() != nil {
+				return fmt.Errorf("Cancelled, %s was not created.", args[0])
+			}
 			return fmt.Errorf("Something went wrong while creating your project. Sorry about that.\n\n  > %w", err)
 		}
 		fmt.Printf(`
@@ -178,29 +260,197 @@ Success! Your new project is ready to go.
 	return cmd
 }
 
+func generateCommand() command {
+	cmd := _newCommand("generate")
+
+	cmd.Run = func(args []string) error {
+		if len(args) != 2 {
+			return fmt.Errorf("Missing generator or name. Try `pack generate <kind> <name>`, e.g. `pack generate component UserProfile`.")
+		}
+		result, err := api.Generate(api.GenerateOptions{
+			Dir:  ".",
+			Kind: args[0],
+			Name: args[1],
+		})
+		if err != nil {
+			return fmt.Errorf("Failed to generate %s %s: %w", args[0], args[1], err)
+		}
+		for _, f := range result.Files {
+			fmt.Printf("  created %s\n", f)
+		}
+		return nil
+	}
+	return cmd
+}
+
+func testCommand() command {
+	cmd := _newCommand("test")
+
+	var run string
+	var watch bool
+	var reporter string
+	var output string
+	cmd.fs.StringVar(&run, "run", "", "only run the tests whose name matches this regular `pattern`")
+	cmd.fs.BoolVar(&watch, "watch", false, "run the tests again when files change")
+	cmd.fs.StringVar(&reporter, "reporter", "pretty", "report format: pretty, tap or junit")
+	cmd.fs.StringVar(&output, "output", "", "write the report to this `file` instead of stdout")
+	var coverage bool
+	var coverageDir string
+	var coverageThreshold float64
+	cmd.fs.BoolVar(&coverage, "coverage", false, "collect code coverage, and write lcov and HTML reports")
+	cmd.fs.StringVar(&coverageDir, "coverage-dir", "coverage", "directory the coverage reports are written to")
+	cmd.fs.Float64Var(&coverageThreshold, "coverage-threshold", 0, "fail if less than this `percent` of lines are covered (implies --coverage)")
+
+	cmd.Run = func(args []string) error {
+		ctx, stop := interruptContext()
+		defer stop()
+		result := api.Test(ctx, api.TestOptions{
+			SourceDir:   "src",
+			Run:         run,
+			Reporter:    reporter,
+			OutputFile:  output,
+			Watch:       watch,
+			Coverage:    coverage || coverageThreshold > 0,
+			CoverageDir: coverageDir,
+			OnResult: func(result api.TestResult) {
+				printMessages(result.Errors, nil)
+			},
+		})
+		if watch {
+			return nil
+		}
+		switch {
+		case len(result.Errors) > 0:
+			return fmt.Errorf("Failed to run the tests.")
+		case result.Failed > 0:
+			return fmt.Errorf("%d of %d tests failed.", result.Failed, result.Passed+result.Failed+result.Skipped)
+		case result.Passed+result.Skipped == 0:
+			if run != "" {
+				return fmt.Errorf("No tests match %q.", run)
+			}
+			return fmt.Errorf("No tests found. Test files are named *_test.ts(x) or *.test.ts(x).")
+		case result.Coverage != nil && result.Coverage.Lines < coverageThreshold:
+			return fmt.Errorf("Coverage of %.1f%% of lines is below the threshold of %.1f%%.", result.Coverage.Lines, coverageThreshold)
+		}
+		return nil
+	}
+	return cmd
+}
+
+func checkCommand() command {
+	cmd := _newCommand("check")
+
+	var watch bool
+	cmd.fs.BoolVar(&watch, "watch", false, "type-check again when files change")
+
+	cmd.Run = func(args []string) error {
+		ctx, stop := interruptContext()
+		defer stop()
+		result := api.Check(ctx, api.CheckOptions{
+			SourceDir: "src",
+			Watch:     watch,
+			OnResult: func(result api.CheckResult) {
+				printMessages(result.Errors, result.Warnings)
+				if watch {
+					fmt.Printf("%s Watching for file changes.\n\n", checkSummary(result))
+				}
+			},
+		})
+		if watch {
+			return nil
+		}
+		if len(result.Errors) > 0 {
+			return fmt.Errorf("%s", checkSummary(result))
+		}
+		fmt.Printf("%s\n", checkSummary(result))
+		return nil
+	}
+	return cmd
+}
+
+func checkSummary(result api.CheckResult) string {
+	switch len(result.Errors) {
+	case 0:
+		return "No type errors."
+	case 1:
+		return "Type check failed with 1 error."
+	default:
+		return fmt.Sprintf("Type check failed with %d errors.", len(result.Errors))
+	}
+}
+
+// printMessages prints errors and warnings, prefixed with the location they
+// point to, if any.
+func printMessages(errs []api.Message, warnings []api.Message) {
+	for _, msg := range warnings {
+		fmt.Printf("[warning]: %s\n", formatMessage(msg))
+	}
+	for _, msg := range errs {
+		fmt.Printf("[error]: %s\n", formatMessage(msg))
+	}
+}
+
+func formatMessage(msg api.Message) string {
+	if msg.Location == nil {
+		return msg.Text
+	}
+	return fmt.Sprintf("%s:%d:%d: %s", msg.Location.File, msg.Location.Line, msg.Location.Column, msg.Text)
+}
+
+// isTerminal reports whether f is an interactive terminal.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
 func serveCommand() command {
 	cmd := _newCommand("serve")
 
 	var host string
 	var port uint
 	var open bool
+	var base string
 	cmd.fs.StringVar(&host, "host", "localhost", "server host")
-	cmd.fs.UintVar(&port, "port", 3000, "server port")
+	cmd.fs.UintVar(&port, "port", 3000, "server port, or 0 for a random free port")
 	cmd.fs.BoolVar(&open, "open", false, "automatically open browser")
+	cmd.fs.StringVar(&base, "base", "/", "public url the app is deployed under")
+	fallback := fallbackFlag{}
+	cmd.fs.Var(fallback, "fallback", "serve `[prefix=]page` for missing pages (repeatable)")
+	var https bool
+	var certFile string
+	var keyFile string
+	var http2 bool
+	cmd.fs.BoolVar(&https, "https", false, "serve over HTTPS with a locally trusted certificate")
+	cmd.fs.StringVar(&certFile, "cert", "", "TLS certificate file to use with --https")
+	cmd.fs.StringVar(&keyFile, "key", "", "TLS private key file to use with --https")
+	cmd.fs.BoolVar(&http2, "http2", false, "enable HTTP/2 (requires --https)")
+	var logFormat string
+	cmd.fs.StringVar(&logFormat, "log-format", "text", "access log format: text, json, combined or none")
 
 	cmd.Run = func(args []string) error {
-		result, err := api.Serve(api.ServeOptions{
-			Path: "dist",
-			Host: host,
-			Port: uint16(port),
-			Open: open,
+		if logFormat == "none" {
+			logFormat = ""
+		}
+		ctx, stop := interruptContext()
+		defer stop()
+		result, err := api.Serve(ctx, api.ServeOptions{
+			Path:       "dist",
+			Host:       host,
+			Port:       uint16(port),
+			Open:       open,
+			PublicPath: base,
+			Fallback:   fallback,
+			HTTPS:      https || certFile != "",
+			CertFile:   certFile,
+			KeyFile:    keyFile,
+			HTTP2:      http2,
+			LogFormat:  logFormat,
 		})
 		if err != nil {
 			return err
 		}
-		fmt.Printf("Server running at %s://%s:%d\n", "http", result.Host, result.Port)
-		result.Wait()
-		return nil
+		printServer(result, port)
+		return waitServer(result)
 	}
 	return cmd
 }
@@ -211,25 +461,198 @@ func startCommand() command {
 	var host string
 	var port uint
 	var open bool
+	var base string
 	cmd.fs.StringVar(&host, "host", "localhost", "server host")
-	cmd.fs.UintVar(&port, "port", 3000, "server port")
+	cmd.fs.UintVar(&port, "port", 3000, "server port, or 0 for a random free port")
 	cmd.fs.BoolVar(&open, "open", false, "automatically open browser")
+	cmd.fs.StringVar(&base, "base", "/", "public url the app is deployed under")
+	fallback := fallbackFlag{}
+	cmd.fs.Var(fallback, "fallback", "serve `[prefix=]page` for missing pages (repeatable)")
+	var https bool
+	var certFile string
+	var keyFile string
+	var http2 bool
+	cmd.fs.BoolVar(&https, "https", false, "serve over HTTPS with a locally trusted certificate")
+	cmd.fs.StringVar(&certFile, "cert", "", "TLS certificate file to use with --https")
+	cmd.fs.StringVar(&keyFile, "key", "", "TLS private key file to use with --https")
+	cmd.fs.BoolVar(&http2, "http2", false, "enable HTTP/2 (requires --https)")
+	var logFormat string
+	cmd.fs.StringVar(&logFormat, "log-format", "text", "access log format: text, json, combined or none")
+	var mocksDir string
+	cmd.fs.StringVar(&mocksDir, "mocks", "mocks", "directory of mock API responses")
+	network := []api.NetworkRule{}
+	cmd.fs.Var(networkFlag{"latency", &network}, "latency", "add `[pattern=]duration` of latency to responses (repeatable)")
+	cmd.fs.Var(networkFlag{"throttle", &network}, "throttle", "limit bandwidth to `[pattern=]rate`, e.g. 50kB/s or slow-3g (repeatable)")
+	cmd.fs.Var(networkFlag{"fail", &network}, "fail", "fail requests with `[pattern=]status@rate` or drop@rate (repeatable)")
+	var typecheck bool
+	cmd.fs.BoolVar(&typecheck, "typecheck", false, "type-check the project with tsc --watch, showing type errors in the browser")
 
 	cmd.Run = func(args []string) error {
-		result, err := api.Start(api.StartOptions{
-			Bundle:    true,
-			SourceDir: "src",
-			StaticDir: "static",
-			Host:      host,
-			Port:      uint16(port),
-			Open:      open,
+		if logFormat == "none" {
+			logFormat = ""
+		}
+		plugins, err := loadPlugins()
+		if err != nil {
+			return err
+		}
+		ctx, stop := interruptContext()
+		defer stop()
+		result, err := api.Start(ctx, api.StartOptions{
+			Bundle:     true,
+			SourceDir:  "src",
+			StaticDir:  "static",
+			Host:       host,
+			Port:       uint16(port),
+			Open:       open,
+			PublicPath: base,
+			Fallback:   fallback,
+			HTTPS:      https || certFile != "",
+			CertFile:   certFile,
+			KeyFile:    keyFile,
+			HTTP2:      http2,
+			LogFormat:  logFormat,
+			MocksDir:   mocksDir,
+			Network:    network,
+			Typecheck:  typecheck,
+			OnTypecheck: func(result api.CheckResult) {
+				printMessages(result.Errors, result.Warnings)
+				fmt.Printf("%s\n", checkSummary(result))
+			},
+			Plugins: plugins,
 		})
 		if err != nil {
 			return err
 		}
-		fmt.Printf("Server running at %s://%s:%d\n", "http", result.Host, result.Port)
-		result.Wait()
-		return nil
+		printServer(result, port)
+		return waitServer(result)
 	}
 	return cmd
 }
+
+// loadPlugins returns the external plugins declared in the project's
+// configuration file.
+func loadPlugins() ([]api.Plugin, error) {
+	config, err := api.LoadConfig(".")
+	if err != nil {
+		return nil, err
+	}
+	plugins := []api.Plugin{}
+	for _, p := range config.Plugins {
+		plugins = append(plugins, p.Plugin())
+	}
+	return plugins, nil
+}
+
+// interruptContext returns a context that is cancelled on SIGINT or SIGTERM,
+// so that builds and servers can stop cleanly. A second signal exits
+// immediately.
+func interruptContext() (context.Context, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-signals:
+			cancel()
+		case <-done:
+			return
+		}
+		select {
+		case <-signals:
+			os.Exit(130)
+		case <-done:
+		}
+	}()
+	return ctx, func() {
+		signal.Stop(signals)
+		cancel()
+		close(done)
+	}
+}
+
+// waitServer waits for the server to stop. Being interrupted isn't an error.
+func waitServer(result api.ServeResult) error {
+	err := result.Wait()
+	if errors.Is(err, api.ErrServerStopped) {
+		fmt.Printf("Server stopped.\n")
+		return nil
+	}
+	return err
+}
+
+func printServer(result api.ServeResult, port uint) {
+	if port != 0 && uint(result.Port) != port {
+		fmt.Printf("Port %d is in use, using %d instead.\n", port, result.Port)
+	}
+	fmt.Printf("Server running at:\n\n")
+	fmt.Printf("  Local:   %s\n", result.URL)
+	for _, url := range result.NetworkURLs {
+		fmt.Printf("  Network: %s\n", url)
+	}
+	if len(result.NetworkURLs) == 0 && result.Host == "localhost" {
+		fmt.Printf("  Network: use --host=0.0.0.0 to expose\n")
+	}
+	fmt.Println()
+}
+
+// fallbackFlag collects --fallback flags into api.ServeOptions.Fallback. The
+// path prefix defaults to "/", so --fallback=/index.html serves index.html
+// for every missing page.
+type fallbackFlag map[string]string
+
+func (f fallbackFlag) String() string {
+	pairs := []string{}
+	for prefix, page := range f {
+		pairs = append(pairs, prefix+"="+page)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (f fallbackFlag) Set(value string) error {
+	prefix, page := "/", value
+	if i := strings.Index(value, "="); i >= 0 {
+		prefix, page = value[:i], value[i+1:]
+	}
+	if page == "" {
+		return fmt.Errorf("missing fallback page in %q", value)
+	}
+	f[prefix] = page
+	return nil
+}
+
+// varsFlag collects --var flags into api.NewOptions.Vars.
+type varsFlag map[string]string
+
+func (f varsFlag) String() string {
+	return ""
+}
+
+func (f varsFlag) Set(value string) error {
+	i := strings.Index(value, "=")
+	if i <= 0 {
+		return fmt.Errorf("expected key=value")
+	}
+	f[value[:i]] = value[i+1:]
+	return nil
+}
+
+// networkFlag collects --latency, --throttle and --fail flags into
+// api.StartOptions.Network.
+type networkFlag struct {
+	kind  string
+	rules *[]api.NetworkRule
+}
+
+func (f networkFlag) String() string {
+	return ""
+}
+
+func (f networkFlag) Set(value string) error {
+	rule, err := api.ParseNetworkRule(f.kind, value)
+	if err != nil {
+		return err
+	}
+	*f.rules = append(*f.rules, rule)
+	return nil
+}
@@ -0,0 +1,58 @@
+// Package templates holds the built-in project templates of "pack new",
+// which are embedded in the binary so that projects can be created offline.
+package templates
+
+import (
+	"embed"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Directories don't embed their dotfiles, so those are listed explicitly.
+//
+//go:embed typescript-react typescript-react/.gitignore typescript-react/.pack
+//go:embed typescript-preact typescript-preact/.gitignore typescript-preact/.pack
+var files embed.FS
+
+// Template is a built-in project template.
+type Template struct {
+	// Name identifies the template, e.g. in "pack new --template=<name>".
+	Name  string
+	Title string
+}
+
+// Builtin lists the built-in templates. The first one is the default.
+var Builtin = []Template{
+	{Name: "typescript-react", Title: "Web App (React)"},
+	{Name: "typescript-preact", Title: "Web App (Preact)"},
+}
+
+// Exists reports whether name is a built-in template.
+func Exists(name string) bool {
+	for _, t := range Builtin {
+		if t.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Copy writes the files of the built-in template name to dir.
+func Copy(name string, dir string) error {
+	return fs.WalkDir(files, name, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel := filepath.FromSlash(p[len(name):])
+		if d.IsDir() {
+			return os.MkdirAll(filepath.Join(dir, rel), 0755)
+		}
+		data, err := files.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(filepath.Join(dir, rel), data, 0644)
+	})
+}